@@ -1,39 +1,108 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"os/signal"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/cdproto/target"
 	"github.com/chromedp/chromedp"
 	"github.com/dlclark/regexp2"
+	"golang.org/x/net/publicsuffix"
 )
 
 var (
 	settings settingsT
 	sitemap  scraping
+	proxies  *proxyPool
+	agents   *userAgentPool
+	limiter  *rateLimiter
+	robots   *robotsCache
+	scope    *crawlScope
+	report   *runReport
+	client   *http.Client
+	cookies  *cookieStore
+	session  *loginSession
+	changes  *changeStore
+	pages    *crawledPages
+
+	// resume continues the crawl saved in the checkpoint file instead of
+	// starting over.
+	resume bool
+
+	// stopping is closed on the first interrupt, after which no new page
+	// is dispatched, nested ones included. crawlCtx is cancelled when the
+	// shutdown timeout runs out, aborting the requests and Chrome sessions
+	// still in flight.
+	stopping = make(chan struct{})
+	crawlCtx = context.Background()
 )
 
 const configFile = "sitemap.json"
 
+const (
+	defaultRetries       = 3
+	defaultRetryDelay    = 1000 * time.Millisecond
+	defaultRetryMaxDelay = 30 * time.Second
+
+	defaultConnectTimeout      = 10 * time.Second
+	defaultReadTimeout         = 30 * time.Second
+	defaultRequestTimeout      = 60 * time.Second
+	defaultMaxIdleConnsPerHost = 10
+	defaultMaxRedirects        = 10
+	defaultMaxBodySize         = 50 << 20
+
+	loginTimeout = 30 * time.Second
+
+	defaultProxyMaxFailures = 3
+	defaultProxyRetest      = 60 * time.Second
+	defaultProxyTestURL     = "http://www.gstatic.com/generate_204"
+	proxyProbeTimeout       = 15 * time.Second
+
+	defaultClickDelay  = 2000 * time.Millisecond
+	defaultScrollDelay = 2000 * time.Millisecond
+	popupTimeout       = 10 * time.Second
+
+	// pageCacheSize is how many nested page outputs are kept for the
+	// records linking to the same pages.
+	pageCacheSize = 1000
+
+	defaultCheckpointInterval = 30 * time.Second
+	defaultShutdownTimeout    = 30 * time.Second
+)
+
 type selectors struct {
 	ID               string   `json:"id"`
 	Type             string   `json:"type"`
@@ -42,13 +111,136 @@ type selectors struct {
 	Multiple         bool     `json:"multiple"`
 	Regex            string   `json:"regex"`
 	Delay            int      `json:"delay"`
-	ExtractAttribute string   `json:"exactAttribute"`
+	ExtractAttribute string   `json:"extractAttribute"`
+
+	ClickElementSelector string `json:"clickElementSelector,omitempty"`
+	ClickType            string `json:"clickType,omitempty"`
+	ClickLimit           int    `json:"clickLimit,omitempty"`
+	ScrollLimit          int    `json:"scrollLimit,omitempty"`
+
+	SitemapXMLURLs []string `json:"sitemapXmlUrls,omitempty"`
+	FoundURLRegex  string   `json:"foundUrlRegex,omitempty"`
+
+	OuterHTML bool `json:"outerHtml,omitempty"`
+}
+
+// UnmarshalJSON also accepts the "exactAttribute" key written by older
+// versions of this tool in place of "extractAttribute".
+func (s *selectors) UnmarshalJSON(data []byte) error {
+	type selectorsAlias selectors
+	legacy := struct {
+		*selectorsAlias
+		ExactAttribute string `json:"exactAttribute"`
+	}{selectorsAlias: (*selectorsAlias)(s)}
+	err := json.Unmarshal(data, &legacy)
+	if err != nil {
+		return err
+	}
+	if s.ExtractAttribute == "" {
+		s.ExtractAttribute = legacy.ExactAttribute
+	}
+	return nil
 }
 
 type scraping struct {
-	ID        string      `json:"_id,omitempty"`
-	StartURL  []string    `json:"startUrl"`
-	Selectors []selectors `json:"selectors"`
+	ID            string         `json:"_id,omitempty"`
+	StartURL      []string       `json:"startUrl"`
+	StartRequests []startRequest `json:"startRequests,omitempty"`
+	Selectors     []selectors    `json:"selectors"`
+
+	RateLimit       float64 `json:"rateLimit,omitempty"`
+	HostConcurrency int     `json:"hostConcurrency,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+
+	Login *loginT `json:"login,omitempty"`
+
+	// MaxDepth counts the links followed from the root start pages.
+	// Pagination does not go deeper: the next pages of a listing are at
+	// the depth of its first page.
+	MaxDepth       int      `json:"maxDepth,omitempty"`
+	AllowedDomains []string `json:"allowedDomains,omitempty"`
+	IncludeURLs    []string `json:"includeUrls,omitempty"`
+	ExcludeURLs    []string `json:"excludeUrls,omitempty"`
+
+	// depth is how many links away from the root start pages the start
+	// pages of a nested sitemap are, and ancestors the pages on those
+	// links.
+	depth     int
+	ancestors []string
+}
+
+// startRequest is a start page that is not a plain GET, such as a search
+// form or an ASP.NET postback. The body is either Form, url-encoded, or
+// JSON, and GET requests send Form in the query string instead. With
+// FormFromPage the hidden inputs of the page at URL, view state included,
+// are fetched first and posted along with Form, then those of each
+// response along with the next iterated value.
+type startRequest struct {
+	URL          string            `json:"url"`
+	Method       string            `json:"method,omitempty"`
+	Form         map[string]string `json:"form,omitempty"`
+	JSON         interface{}       `json:"json,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	FormFromPage bool              `json:"formFromPage,omitempty"`
+	Iterate      *iterateParam     `json:"iterate,omitempty"`
+}
+
+// iterateParam repeats a start request for every value of a body
+// parameter, taken from Values or from a Range such as "1-20", "0-100:10"
+// or "001-100", the syntax of start URL ranges. A "{value}"
+// placeholder in the parameter's configured value is replaced, so that
+// "Page${value}" gives "Page$1", "Page$2"...
+type iterateParam struct {
+	Param  string   `json:"param"`
+	Range  string   `json:"range,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// pageRequest is how a start request is actually sent.
+type pageRequest struct {
+	method      string
+	body        []byte
+	contentType string
+	headers     map[string]string
+	chain       *postback
+}
+
+// postback follows the values of a FormFromPage start request. ASP.NET
+// pages only accept a postback carrying the view state of the previous
+// one, so each value is posted with the hidden inputs of the page the
+// previous value returned. index is the start request's position in the
+// sitemap, kept in checkpoints.
+type postback struct {
+	start    startRequest
+	index    int
+	values   []string
+	position int
+}
+
+// loginT describes how to log in before crawling, either by posting the
+// login form ("form") or by running a sequence of steps in Chrome
+// ("chrome"). Success is checked with SuccessSelector on the page reached
+// after logging in, and pages containing ExpiredSelector trigger a new
+// login.
+type loginT struct {
+	Type            string            `json:"type"`
+	URL             string            `json:"url"`
+	Action          string            `json:"action,omitempty"`
+	Fields          map[string]string `json:"fields,omitempty"`
+	CSRFSelector    string            `json:"csrfSelector,omitempty"`
+	Steps           []loginStep       `json:"steps,omitempty"`
+	SuccessSelector string            `json:"successSelector"`
+	ExpiredSelector string            `json:"expiredSelector,omitempty"`
+}
+
+// loginStep is one Chrome action: "fill" types Value into Selector,
+// "click" clicks it, "wait" waits for it to be visible and "sleep" pauses
+// for Value milliseconds.
+type loginStep struct {
+	Action   string `json:"action"`
+	Selector string `json:"selector,omitempty"`
+	Value    string `json:"value,omitempty"`
 }
 
 type settingsT struct {
@@ -62,6 +254,44 @@ type settingsT struct {
 	Proxy      []string `json:"proxy"`
 	LogFile    string   `json:"log_file"`
 	OutputFile string   `json:"output_filename"`
+
+	Retries       int `json:"retries"`
+	RetryDelay    int `json:"retry_delay"`
+	RetryMaxDelay int `json:"retry_max_delay"`
+
+	ProxyRotation    string `json:"proxy_rotation"`
+	ProxyMaxFailures int    `json:"proxy_max_failures"`
+	ProxyRetest      int    `json:"proxy_retest"`
+	ProxyTestURL     string `json:"proxy_test_url"`
+
+	UserAgentRotation string `json:"user_agent_rotation"`
+	UserAgentWeights  []int  `json:"user_agent_weights"`
+	HeaderProfiles    bool   `json:"header_profiles"`
+
+	RateLimit       float64 `json:"rate_limit"`
+	RateBurst       int     `json:"rate_burst"`
+	HostConcurrency int     `json:"host_concurrency"`
+
+	IgnoreRobots bool `json:"ignore_robots"`
+
+	ConnectTimeout      int   `json:"connect_timeout"`
+	ReadTimeout         int   `json:"read_timeout"`
+	RequestTimeout      int   `json:"request_timeout"`
+	MaxIdleConnsPerHost int   `json:"max_idle_conns_per_host"`
+	HTTP2               bool  `json:"http2"`
+	MaxRedirects        int   `json:"max_redirects"`
+	MaxBodySize         int64 `json:"max_body_size"`
+
+	CookieFile   string `json:"cookie_file"`
+	CookieImport string `json:"cookie_import"`
+
+	CheckpointFile     string `json:"checkpoint_file"`
+	CheckpointInterval int    `json:"checkpoint_interval"`
+
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	Incremental     bool   `json:"incremental"`
+	IncrementalFile string `json:"incremental_file"`
 }
 
 type jsonType struct {
@@ -71,11 +301,259 @@ type jsonType struct {
 
 type workerJob struct {
 	startURL   string
+	request    *pageRequest
+	depth      int
 	parent     string
+	claimed    bool
+	partial    bool
 	siteMap    *scraping
 	linkOutput map[string]interface{}
 }
 
+// httpError is returned when a page answers with a non-2xx status code.
+type httpError struct {
+	url        string
+	statusCode int
+	retryAfter time.Duration
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.url, e.statusCode, http.StatusText(e.statusCode))
+}
+
+type sitemapXML struct {
+	URLs     []sitemapXMLLoc `xml:"url"`
+	Sitemaps []sitemapXMLLoc `xml:"sitemap"`
+}
+
+type sitemapXMLLoc struct {
+	Loc string `xml:"loc"`
+}
+
+type proxyT struct {
+	url       *url.URL
+	failures  int
+	dead      bool
+	deadUntil time.Time
+	attempts  int
+	successes int
+}
+
+// proxyPool hands out the configured proxies according to the rotation
+// setting and keeps track of their health. A proxy failing several times
+// in a row is left out of the rotation until a re-test request through it
+// succeeds.
+type proxyPool struct {
+	sync.Mutex
+	proxies []*proxyT
+	next    int
+	sticky  map[string]*proxyT
+}
+
+// urlFrontier is the queue of pages a scraper still has to visit. Workers
+// add the pages they discover while the dispatcher takes them out, and the
+// crawl is over once the queue is empty and no page is being scraped, as
+// that page could still add more.
+type urlFrontier struct {
+	sync.Mutex
+	cond      *sync.Cond
+	queue     []workerJob
+	seen      map[string]bool
+	running   map[string]workerJob
+	completed map[string]bool
+	active    int
+	stopped   bool
+	// saving is held while a page is written out and marked complete,
+	// and while the checkpoint is taken.
+	saving sync.Mutex
+}
+
+// crawledPages is the part of the frontier shared by every scraper of the
+// run, nested ones included. A nested page is scraped once per selector:
+// a record linking to a page still being scraped waits for its output,
+// and one linking to it later reuses it while it is among the last
+// pageCacheSize pages scraped. Links back to a page on their own link path
+// are left out. When waiting would deadlock, because the page being
+// scraped is itself waiting for a page on the link path, the page is
+// scraped again instead.
+type crawledPages struct {
+	sync.Mutex
+	cond     *sync.Cond
+	scraping map[string]bool
+	// waiting counts, for every page being scraped, the pages its nested
+	// scrapers wait for.
+	waiting map[string]map[string]int
+	outputs map[string]map[string]interface{}
+	order   []string
+}
+
+// linkPath is where a page is in the crawl: how many links away from the
+// root start pages and the pages on those links, itself included. stopped
+// is set when a nested scraper of the page was stopped before scraping
+// every linked page, so its output is partial.
+type linkPath struct {
+	depth   int
+	pages   []string
+	stopped *bool
+}
+
+// checkpointState is what the checkpoint file holds: every page seen so
+// far, the ones still to scrape, queued or in flight when it was saved,
+// and the ones already written to the output.
+type checkpointState struct {
+	Seen      []string        `json:"seen"`
+	Pending   []checkpointJob `json:"pending"`
+	Completed []string        `json:"completed"`
+}
+
+type checkpointJob struct {
+	URL         string            `json:"url"`
+	Depth       int               `json:"depth,omitempty"`
+	Method      string            `json:"method,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// StartRequest is the position of a FormFromPage start request plus
+	// one and Value the position of the value posted.
+	StartRequest int `json:"startRequest,omitempty"`
+	Value        int `json:"value,omitempty"`
+}
+
+// userAgentPool is shared by all workers so every configured user agent
+// gets used, either in turn, at random by weight or sticking to one agent
+// per domain.
+type userAgentPool struct {
+	sync.Mutex
+	userAgents []string
+	weights    []int
+	next       int
+	sticky     map[string]string
+}
+
+// rateLimiter throttles requests per host with a token bucket refilled at
+// the configured requests per second, and caps how many requests to the
+// same host may be in flight at once.
+type rateLimiter struct {
+	sync.Mutex
+	rate        float64
+	burst       int
+	concurrency int
+	hosts       map[string]*hostLimit
+}
+
+type hostLimit struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+	slots  chan struct{}
+}
+
+// robotsCache keeps the parsed robots.txt of every host seen in the run.
+type robotsCache struct {
+	sync.Mutex
+	hosts map[string]*robotsRules
+}
+
+type robotsRules struct {
+	once        sync.Once
+	rules       []robotsRule
+	disallowAll bool
+	crawlDelay  time.Duration
+	sitemaps    []string
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp2.Regexp
+}
+
+// runReport gathers what happened during the run for the summary printed
+// once scraping is over.
+type runReport struct {
+	sync.Mutex
+	robotsSkipped []string
+	filtered      map[string]int
+}
+
+// crawlScope bounds a crawl to the max depth, domains and URL rules of
+// the sitemap.
+type crawlScope struct {
+	maxDepth int
+	domains  []string
+	include  []*regexp2.Regexp
+	exclude  []*regexp2.Regexp
+}
+
+// changeStore remembers the root pages of previous runs for incremental
+// crawling: the ETag and Last-Modified to revalidate them with, the hash
+// of their record to tell whether it changed and their gzipped body. A
+// page that was not modified is scraped again from that body, so its
+// pagination and the detail pages it links to are still followed and
+// compared. The pages they link to are kept the same way, without a
+// hash, so those not modified are not downloaded again either.
+type changeStore struct {
+	sync.Mutex
+	enabled    bool
+	previous   map[string]pageState
+	current    map[string]pageState
+	linked     map[string]pageState
+	validators map[string]pageState
+}
+
+type pageState struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	Body         []byte `json:"body,omitempty"`
+}
+
+// changeState is the incremental file: the pages of the last complete
+// run and, while a run is interrupted, the ones it already went through.
+// Linked holds the pages linked from them.
+type changeState struct {
+	Pages   map[string]pageState `json:"pages"`
+	Current map[string]pageState `json:"current,omitempty"`
+	Linked  map[string]pageState `json:"linked,omitempty"`
+}
+
+type proxyKey struct{}
+
+// headerKey carries the http.Header a request's response headers are
+// copied to.
+type headerKey struct{}
+
+// loginSession counts the logins done during the run, so workers hitting
+// an expired session at the same time only log in again once.
+type loginSession struct {
+	sync.Mutex
+	generation int
+}
+
+// cookieStore is the cookie jar shared by the HTTP client and the Chrome
+// sessions. Unlike cookiejar.Jar it remembers every cookie it holds so they
+// can be saved between runs and handed over to Chrome.
+type cookieStore struct {
+	sync.Mutex
+	jar     *cookiejar.Jar
+	cookies map[string]storedCookie
+}
+
+// storedCookie uses the format of browser cookie exports, which is also
+// the format of the cookie file.
+type storedCookie struct {
+	Domain         string  `json:"domain"`
+	HostOnly       bool    `json:"hostOnly"`
+	Path           string  `json:"path"`
+	Secure         bool    `json:"secure"`
+	HTTPOnly       bool    `json:"httpOnly"`
+	Session        bool    `json:"session"`
+	ExpirationDate float64 `json:"expirationDate,omitempty"`
+	Name           string  `json:"name"`
+	Value          string  `json:"value"`
+}
+
 type audioPostBody struct {
 	Audio  audioPostAudio    `json:"audio"`
 	Config recognitionConfig `json:"config"`
@@ -148,637 +626,3577 @@ func logErrors(error error) {
 	}
 }
 
-func readJSON() {
-	jsonData := jsonType{}
-	data, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		logErrors(err)
+func newProxyPool(proxyList []string) *proxyPool {
+	pool := &proxyPool{sticky: make(map[string]*proxyT)}
+	for _, proxyString := range proxyList {
+		proxyString = strings.TrimSpace(proxyString)
+		if proxyString == "" {
+			continue
+		}
+		if !strings.Contains(proxyString, "://") {
+			proxyString = "http://" + proxyString
+		}
+		proxyURL, err := url.Parse(proxyString)
+		if err != nil {
+			logErrors(err)
+			continue
+		}
+		pool.proxies = append(pool.proxies, &proxyT{url: proxyURL})
 	}
+	return pool
+}
 
-	err = json.Unmarshal(data, &jsonData)
-	if err != nil {
-		logErrors(err)
+// get returns the proxy to use for a request to host, or nil when no proxy
+// is configured.
+func (p *proxyPool) get(host string) *proxyT {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.proxies) == 0 {
+		return nil
 	}
 
-	sitemap = jsonData.Sitemap
-	settings = jsonData.Settings
+	var alive []*proxyT
+	for _, proxy := range p.proxies {
+		if !proxy.dead {
+			alive = append(alive, proxy)
+		}
+	}
+	if len(alive) == 0 {
+		// every proxy is dead, use the one due for a re-test the soonest
+		// rather than leaking requests without a proxy
+		soonest := p.proxies[0]
+		for _, proxy := range p.proxies {
+			if proxy.deadUntil.Before(soonest.deadUntil) {
+				soonest = proxy
+			}
+		}
+		return soonest
+	}
+
+	switch settings.ProxyRotation {
+	case "random":
+		return alive[rand.Intn(len(alive))]
+	case "sticky":
+		proxy, ok := p.sticky[host]
+		if ok && !proxy.dead {
+			return proxy
+		}
+		proxy = alive[p.next%len(alive)]
+		p.next++
+		p.sticky[host] = proxy
+		return proxy
+	default:
+		proxy := alive[p.next%len(alive)]
+		p.next++
+		return proxy
+	}
 }
 
-func writeJSON() {
-	jsonData := jsonType{settings, sitemap}
-	dataJSON, err := json.MarshalIndent(jsonData, "", "  ")
-	if err != nil {
-		logErrors(err)
+// report records the outcome of a request made through proxy.
+func (p *proxyPool) report(proxy *proxyT, err error) {
+	if proxy == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	proxy.attempts++
+	if !proxyFailure(err) {
+		proxy.successes++
+		proxy.failures = 0
+		return
+	}
+	proxy.failures++
+	maxFailures := settings.ProxyMaxFailures
+	if maxFailures == 0 {
+		maxFailures = defaultProxyMaxFailures
 	}
+	if proxy.failures >= maxFailures && !proxy.dead {
+		proxy.dead = true
+		logErrors(fmt.Errorf("proxy %s marked dead: %v", proxy.url.Redacted(), err))
+		p.scheduleRetest(proxy)
+	}
+}
 
-	err = ioutil.WriteFile(configFile, dataJSON, 0644)
+// scheduleRetest probes a dead proxy once the re-test delay is over. Must
+// be called with the pool locked.
+func (p *proxyPool) scheduleRetest(proxy *proxyT) {
+	retest := defaultProxyRetest
+	if settings.ProxyRetest > 0 {
+		retest = time.Duration(settings.ProxyRetest) * time.Second
+	}
+	proxy.deadUntil = time.Now().Add(retest)
+	time.AfterFunc(retest, func() {
+		err := probeProxy(proxy)
+		p.Lock()
+		defer p.Unlock()
+		if err != nil {
+			logErrors(fmt.Errorf("proxy %s still dead: %v", proxy.url.Redacted(), err))
+			p.scheduleRetest(proxy)
+			return
+		}
+		proxy.dead = false
+		proxy.failures = 0
+		logErrors(fmt.Errorf("proxy %s is back", proxy.url.Redacted()))
+	})
+}
+
+// probeProxy requests the proxy test URL through proxy. Any response the
+// proxy relays counts, only proxy errors fail the probe.
+func probeProxy(proxy *proxyT) error {
+	testURL := settings.ProxyTestURL
+	if testURL == "" {
+		testURL = defaultProxyTestURL
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(crawlCtx, proxyKey{}, proxy), proxyProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, testURL, nil)
 	if err != nil {
-		logErrors(err)
+		return err
 	}
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusProxyAuthRequired {
+		return &httpError{url: testURL, statusCode: response.StatusCode}
+	}
+	return nil
 }
 
-func selectorText(doc *goquery.Document, selector *selectors) []string {
-	var text []string
-	var matchText *regexp2.Match
-	doc.Find(selector.Selector).EachWithBreak(
-		func(i int, s *goquery.Selection) bool {
-			if selector.Regex != "" {
-				re := regexp2.MustCompile(selector.Regex, 0)
-				matchText, _ = re.FindStringMatch(s.Text())
-				if matchText != nil {
-					text = append(text, strings.TrimSpace(matchText.String()))
-				} else {
-					text = append(text, strings.TrimSpace(s.Text()))
-				}
-			} else {
-				text = append(text, strings.TrimSpace(s.Text()))
-			}
+// summary prints the success rate of every proxy used during the run.
+func (p *proxyPool) summary() {
+	p.Lock()
+	defer p.Unlock()
+	for _, proxy := range p.proxies {
+		if proxy.attempts == 0 {
+			continue
+		}
+		fmt.Printf("Proxy: %s %d/%d requests succeeded (%.1f%%)\n", proxy.url.Redacted(), proxy.successes, proxy.attempts, float64(proxy.successes)*100/float64(proxy.attempts))
+	}
+}
 
-			return selector.Multiple
-		},
-	)
-	return text
+// proxyFailure reports whether err should count against the proxy: the
+// proxy could not be reached or refused our credentials. Errors reaching
+// the target site, DNS failures and timeouts included, are not the proxy's
+// fault.
+func proxyFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var statusErr *httpError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusProxyAuthRequired
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return true
+	}
+	message := err.Error()
+	for _, proxyError := range []string{
+		// CONNECT tunnel refused by an http proxy
+		"Proxy Authentication Required",
+		// socks5 credentials rejected
+		"username/password authentication failed",
+		// Chrome
+		"ERR_PROXY_CONNECTION_FAILED",
+		"ERR_PROXY_AUTH_UNSUPPORTED",
+		"ERR_PROXY_AUTH_REQUESTED",
+		"ERR_TUNNEL_CONNECTION_FAILED",
+		"ERR_SOCKS_CONNECTION_FAILED",
+	} {
+		if strings.Contains(message, proxyError) {
+			return true
+		}
+	}
+	return false
 }
 
-func selectorLink(doc *goquery.Document, selector *selectors, baseURL string) []string {
-	var links []string
-	doc.Find(selector.Selector).EachWithBreak(
-		func(i int, s *goquery.Selection) bool {
-			href, ok := s.Attr("href")
-			if !ok {
-				fmt.Println("Error: HREF has not been found.")
-			}
+func newUserAgentPool(userAgents []string, weights []int) *userAgentPool {
+	pool := &userAgentPool{sticky: make(map[string]string)}
+	for i, userAgent := range userAgents {
+		if strings.TrimSpace(userAgent) == "" {
+			continue
+		}
+		weight := 1
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		pool.userAgents = append(pool.userAgents, userAgent)
+		pool.weights = append(pool.weights, weight)
+	}
+	return pool
+}
 
-			links = append(links, toFixedURL(href, baseURL))
+// get returns the user agent for a request to host, or an empty string
+// when none is configured.
+func (p *userAgentPool) get(host string) string {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.userAgents) == 0 {
+		return ""
+	}
 
-			return selector.Multiple
-		},
-	)
-	return links
+	switch settings.UserAgentRotation {
+	case "random":
+		total := 0
+		for _, weight := range p.weights {
+			total += weight
+		}
+		pick := rand.Intn(total)
+		for i, weight := range p.weights {
+			if pick < weight {
+				return p.userAgents[i]
+			}
+			pick -= weight
+		}
+		return p.userAgents[len(p.userAgents)-1]
+	case "sticky":
+		userAgent, ok := p.sticky[host]
+		if !ok {
+			userAgent = p.userAgents[p.next%len(p.userAgents)]
+			p.next++
+			p.sticky[host] = userAgent
+		}
+		return userAgent
+	default:
+		userAgent := p.userAgents[p.next%len(p.userAgents)]
+		p.next++
+		return userAgent
+	}
 }
 
-func selectorElementAttribute(doc *goquery.Document, selector *selectors) []string {
-	var links []string
-	doc.Find(selector.Selector).EachWithBreak(
-		func(i int, s *goquery.Selection) bool {
-			href, ok := s.Attr(selector.ExtractAttribute)
-			if !ok {
-				fmt.Println("Error: HREF has not been found.")
-			}
-			links = append(links, href)
+// userAgentHeaders returns the headers a real browser sending userAgent
+// would add, so requests look consistent with the chosen agent.
+func userAgentHeaders(userAgent string) map[string]string {
+	headers := map[string]string{
+		"Accept-Language": "en-US,en;q=0.9",
+	}
+	chromeVersion := regexp2.MustCompile(`(?:Chrome|Chromium)/(\d+)`, 0)
+	switch {
+	case strings.Contains(userAgent, "Firefox/"):
+		headers["Accept"] = "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8"
+	case strings.Contains(userAgent, "Chrome/") || strings.Contains(userAgent, "Chromium/"):
+		headers["Accept"] = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9"
+		version := "0"
+		match, _ := chromeVersion.FindStringMatch(userAgent)
+		if match != nil {
+			version = match.GroupByNumber(1).String()
+		}
+		brand := "Google Chrome"
+		if strings.Contains(userAgent, "Edg/") {
+			brand = "Microsoft Edge"
+		}
+		headers["sec-ch-ua"] = fmt.Sprintf(`"%s";v="%s", "Chromium";v="%s", "Not=A?Brand";v="99"`, brand, version, version)
+		headers["sec-ch-ua-mobile"] = ifThenElse(strings.Contains(userAgent, "Mobile"), "?1", "?0")
+		headers["sec-ch-ua-platform"] = `"` + userAgentPlatform(userAgent) + `"`
+	case strings.Contains(userAgent, "Safari/"):
+		headers["Accept"] = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	}
+	return headers
+}
 
-			return selector.Multiple
-		},
-	)
-	return links
+func userAgentPlatform(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		return "Android"
+	case strings.Contains(userAgent, "Windows"):
+		return "Windows"
+	case strings.Contains(userAgent, "Macintosh"):
+		return "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		return "Chrome OS"
+	case strings.Contains(userAgent, "Linux"):
+		return "Linux"
+	}
+	return "Unknown"
 }
 
-func selectorElement(doc *goquery.Document, selector *selectors) []interface{} {
-	baseSiteMap := sitemap
-	var elementOutputList []interface{}
-	doc.Find(selector.Selector).EachWithBreak(
-		func(i int, s *goquery.Selection) bool {
-			elementOutput := make(map[string]interface{})
-			for _, elementSelector := range baseSiteMap.Selectors {
-				if selector.ID == elementSelector.ParentSelectors[0] {
-					if elementSelector.Type == "SelectorText" {
-						resultText := s.Find(elementSelector.Selector).Text()
-						elementOutput[elementSelector.ID] = resultText
-					} else if elementSelector.Type == "SelectorImage" {
-						resultText, ok := s.Find(elementSelector.Selector).Attr("src")
-						if !ok {
-							fmt.Println("Error: HREF has not been found.")
-						}
-						elementOutput[elementSelector.ID] = resultText
-					} else if elementSelector.Type == "SelectorLink" {
-						resultText, ok := s.Find(elementSelector.Selector).Attr("href")
-						if !ok {
-							fmt.Println("Error: HREF has not been found.")
-						}
-						elementOutput[elementSelector.ID] = resultText
-					}
-				}
-			}
-			if len(elementOutput) != 0 {
-				elementOutputList = append(elementOutputList, elementOutput)
-			}
+// newRateLimiter builds the limiter from the sitemap limits, falling back
+// to the global settings for those the sitemap leaves unset.
+func newRateLimiter(siteMap *scraping) *rateLimiter {
+	l := &rateLimiter{
+		rate:        settings.RateLimit,
+		burst:       settings.RateBurst,
+		concurrency: settings.HostConcurrency,
+		hosts:       make(map[string]*hostLimit),
+	}
+	if siteMap.RateLimit > 0 {
+		l.rate = siteMap.RateLimit
+	}
+	if siteMap.HostConcurrency > 0 {
+		l.concurrency = siteMap.HostConcurrency
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	return l
+}
 
-			return selector.Multiple
-		},
-	)
-	return elementOutputList
+// acquire blocks until a request to host is allowed and returns the func
+// releasing its in-flight slot.
+func (l *rateLimiter) acquire(host string) func() {
+	l.Lock()
+	h := l.host(host)
+	l.Unlock()
+
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-crawlCtx.Done():
+			// The request fails on the cancelled context anyway.
+			return func() {}
+		}
+	}
+
+	l.Lock()
+	var wait time.Duration
+	if h.rate > 0 {
+		now := time.Now()
+		h.tokens += now.Sub(h.last).Seconds() * h.rate
+		if h.tokens > float64(h.burst) {
+			h.tokens = float64(h.burst)
+		}
+		h.last = now
+		// a negative balance reserves a future token
+		h.tokens--
+		if h.tokens < 0 {
+			wait = time.Duration(-h.tokens / h.rate * float64(time.Second))
+		}
+	}
+	l.Unlock()
+	pause(wait)
+
+	return func() {
+		if h.slots != nil {
+			<-h.slots
+		}
+	}
 }
 
-func selectorImage(doc *goquery.Document, selector *selectors) []string {
-	var sources []string
-	doc.Find(selector.Selector).EachWithBreak(func(i int, s *goquery.Selection) bool {
-		src, ok := s.Attr("src")
-		if !ok {
-			fmt.Println("Error: HREF has not been found.")
+// host returns the limits of host, creating them on first use. The caller
+// must hold the lock.
+func (l *rateLimiter) host(host string) *hostLimit {
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{rate: l.rate, burst: l.burst, tokens: float64(l.burst), last: time.Now()}
+		if l.concurrency > 0 {
+			h.slots = make(chan struct{}, l.concurrency)
 		}
-		sources = append(sources, src)
+		l.hosts[host] = h
+	}
+	return h
+}
 
-		return selector.Multiple
-	})
-	return sources
+// crawlDelay slows host down to one request per delay when that is stricter
+// than the configured rate. Its burst drops to 1 either way, so requests
+// never go out back to back after an idle period.
+func (l *rateLimiter) crawlDelay(host string, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	h := l.host(host)
+	h.burst = 1
+	if h.tokens > 1 {
+		h.tokens = 1
+	}
+	rate := float64(time.Second) / float64(delay)
+	if h.rate == 0 || rate < h.rate {
+		h.rate = rate
+		h.tokens = 0
+	}
 }
 
-func selectorTable(doc *goquery.Document, selector *selectors) map[string]interface{} {
-	var headings, row []string
-	var rows = [][]string{}
-	table := make(map[string]interface{})
-	doc.Find(selector.Selector).Each(func(_ int, tableHTML *goquery.Selection) {
-		tableHTML.Find("tr").Each(func(_ int, rowHTML *goquery.Selection) {
-			rowHTML.Find("th").Each(func(_ int, tableHeading *goquery.Selection) {
-				headings = append(headings, tableHeading.Text())
-			})
-			rowHTML.Find("td").Each(func(_ int, tableCell *goquery.Selection) {
-				row = append(row, tableCell.Text())
-			})
-			if len(row) != 0 {
-				rows = append(rows, row)
-				row = nil
+func urlHost(href string) string {
+	uri, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	return uri.Hostname()
+}
+
+func readJSON() {
+	jsonData := jsonType{Settings: defaultSettings()}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		logErrors(err)
+	}
+
+	err = json.Unmarshal(data, &jsonData)
+	if err != nil {
+		logErrors(err)
+	}
+
+	sitemap = jsonData.Sitemap
+	settings = jsonData.Settings
+	proxies = newProxyPool(settings.Proxy)
+	agents = newUserAgentPool(settings.UserAgents, settings.UserAgentWeights)
+	limiter = newRateLimiter(&sitemap)
+	robots = &robotsCache{hosts: make(map[string]*robotsRules)}
+	scope = newCrawlScope(&sitemap)
+	cookies = newCookieStore()
+	client = newHTTPClient()
+	changes = newChangeStore()
+}
+
+func newCookieStore() *cookieStore {
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return &cookieStore{jar: jar, cookies: make(map[string]storedCookie)}
+}
+
+func (c *cookieStore) SetCookies(u *url.URL, httpCookies []*http.Cookie) {
+	c.jar.SetCookies(u, httpCookies)
+	c.Lock()
+	defer c.Unlock()
+	for _, cookie := range httpCookies {
+		if !cookieDomainAllowed(u.Hostname(), cookie.Domain) {
+			// rejected by the jar too
+			continue
+		}
+		stored := storedCookie{
+			Domain:   strings.ToLower(strings.TrimPrefix(cookie.Domain, ".")),
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HTTPOnly: cookie.HttpOnly,
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+		}
+		if stored.Domain == "" {
+			stored.Domain = u.Hostname()
+			stored.HostOnly = true
+		}
+		if stored.Path == "" || !strings.HasPrefix(stored.Path, "/") {
+			stored.Path = defaultCookiePath(u.Path)
+		}
+		switch {
+		case cookie.MaxAge < 0:
+			delete(c.cookies, stored.key())
+			continue
+		case cookie.MaxAge > 0:
+			stored.ExpirationDate = float64(time.Now().Add(time.Duration(cookie.MaxAge) * time.Second).Unix())
+		case !cookie.Expires.IsZero():
+			if cookie.Expires.Before(time.Now()) {
+				delete(c.cookies, stored.key())
+				continue
 			}
+			stored.ExpirationDate = float64(cookie.Expires.Unix())
+		default:
+			stored.Session = true
+		}
+		c.cookies[stored.key()] = stored
+	}
+}
+
+// cookieDomainAllowed applies the jar's rules to the Domain attribute of a
+// cookie set by host: the domain must be host or a parent of it, and not a
+// public suffix such as "com" or "co.uk".
+func cookieDomainAllowed(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	if domain == "" || domain == host {
+		return true
+	}
+	if net.ParseIP(host) != nil || !strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix != domain
+}
+
+// defaultCookiePath is the path of a cookie set without one, as of RFC
+// 6265 section 5.1.4: the directory of the request path.
+func defaultCookiePath(requestPath string) string {
+	if !strings.HasPrefix(requestPath, "/") {
+		return "/"
+	}
+	i := strings.LastIndex(requestPath, "/")
+	if i == 0 {
+		return "/"
+	}
+	return requestPath[:i]
+}
+
+func (c *cookieStore) Cookies(u *url.URL) []*http.Cookie {
+	return c.jar.Cookies(u)
+}
+
+// add puts a cookie read from a file or from Chrome into the jar.
+func (c *cookieStore) add(stored storedCookie) {
+	if stored.Name == "" || stored.Domain == "" {
+		return
+	}
+	if stored.ExpirationDate != 0 && time.Unix(int64(stored.ExpirationDate), 0).Before(time.Now()) {
+		return
+	}
+	host := strings.TrimPrefix(stored.Domain, ".")
+	cookie := &http.Cookie{
+		Name:     stored.Name,
+		Value:    stored.Value,
+		Path:     stored.Path,
+		Secure:   stored.Secure,
+		HttpOnly: stored.HTTPOnly,
+	}
+	if !stored.HostOnly {
+		cookie.Domain = host
+	}
+	if stored.ExpirationDate != 0 && !stored.Session {
+		cookie.Expires = time.Unix(int64(stored.ExpirationDate), 0)
+	}
+	scheme := "http"
+	if stored.Secure {
+		scheme = "https"
+	}
+	c.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: stored.Path}, []*http.Cookie{cookie})
+}
+
+func (c *cookieStore) all() []storedCookie {
+	c.Lock()
+	defer c.Unlock()
+	var all []storedCookie
+	for _, stored := range c.cookies {
+		all = append(all, stored)
+	}
+	return all
+}
+
+func (stored storedCookie) key() string {
+	return stored.Domain + ";" + stored.Path + ";" + stored.Name
+}
+
+// loadCookies reads a cookie file, either a Netscape cookies.txt or a JSON
+// browser export.
+func loadCookies(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var stored []storedCookie
+		err = json.Unmarshal(trimmed, &stored)
+		if err != nil {
+			return err
+		}
+		for _, cookie := range stored {
+			cookies.add(cookie)
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		expires, _ := strconv.ParseFloat(fields[4], 64)
+		cookies.add(storedCookie{
+			Domain:         fields[0],
+			HostOnly:       !strings.EqualFold(fields[1], "TRUE"),
+			Path:           fields[2],
+			Secure:         strings.EqualFold(fields[3], "TRUE"),
+			HTTPOnly:       httpOnly,
+			Session:        expires == 0,
+			ExpirationDate: expires,
+			Name:           fields[5],
+			Value:          fields[6],
 		})
-	})
-	table["header"] = headings
-	table["rows"] = rows
-	return table
+	}
+	return scanner.Err()
 }
 
-func parseCatchAudio(url string) (string, error) {
-	var speechBody speechRecognitionResponse
-	// Get the data
-	resp, err := http.Get(url)
+// saveCookies writes the jar to the cookie file so the session survives
+// until the next run.
+func saveCookies() {
+	if settings.CookieFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(cookies.all(), "", "  ")
 	if err != nil {
-		return "", err
+		logErrors(err)
+		return
 	}
-	defer resp.Body.Close()
+	err = ioutil.WriteFile(settings.CookieFile, data, 0600)
+	if err != nil {
+		logErrors(err)
+	}
+}
 
-	buf := new(bytes.Buffer)
+// chromeCookies converts the jar for Network.setCookies.
+func chromeCookies() []*network.CookieParam {
+	var params []*network.CookieParam
+	for _, stored := range cookies.all() {
+		param := &network.CookieParam{
+			Name:     stored.Name,
+			Value:    stored.Value,
+			Path:     stored.Path,
+			Secure:   stored.Secure,
+			HTTPOnly: stored.HTTPOnly,
+		}
+		if stored.HostOnly {
+			scheme := "http"
+			if stored.Secure {
+				scheme = "https"
+			}
+			param.URL = scheme + "://" + stored.Domain + stored.Path
+		} else {
+			param.Domain = "." + stored.Domain
+		}
+		if !stored.Session && stored.ExpirationDate != 0 {
+			expires := cdp.TimeSinceEpoch(time.Unix(int64(stored.ExpirationDate), 0))
+			param.Expires = &expires
+		}
+		params = append(params, param)
+	}
+	return params
+}
 
-	// Write the audio body to the buffer
-	_, err = io.Copy(buf, resp.Body)
+// requestHeaders returns the extra headers sent with every request: the
+// user agent profile, overridden by the sitemap headers.
+func requestHeaders(userAgent string) map[string]string {
+	headers := make(map[string]string)
+	if len(userAgent) > 0 && settings.HeaderProfiles {
+		for key, value := range userAgentHeaders(userAgent) {
+			headers[key] = value
+		}
+	}
+	for key, value := range sitemap.Headers {
+		headers[key] = value
+	}
+	return headers
+}
 
-	if err != nil {
-		return "", err
+// defaultSettings are the values sitemap.json ships with, used for the
+// settings missing from an older config.
+func defaultSettings() settingsT {
+	return settingsT{
+		Retries:             defaultRetries,
+		RetryDelay:          int(defaultRetryDelay / time.Millisecond),
+		RetryMaxDelay:       int(defaultRetryMaxDelay / time.Millisecond),
+		ProxyRotation:       "round-robin",
+		ProxyMaxFailures:    defaultProxyMaxFailures,
+		ProxyRetest:         int(defaultProxyRetest / time.Second),
+		ProxyTestURL:        defaultProxyTestURL,
+		UserAgentRotation:   "round-robin",
+		RateBurst:           1,
+		ConnectTimeout:      int(defaultConnectTimeout / time.Second),
+		ReadTimeout:         int(defaultReadTimeout / time.Second),
+		RequestTimeout:      int(defaultRequestTimeout / time.Second),
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		HTTP2:               true,
+		MaxRedirects:        defaultMaxRedirects,
+		MaxBodySize:         defaultMaxBodySize,
+		CookieFile:          "cookies.json",
+		CheckpointFile:      "checkpoint.json",
+		CheckpointInterval:  int(defaultCheckpointInterval / time.Second),
+		ShutdownTimeout:     int(defaultShutdownTimeout / time.Second),
+		IncrementalFile:     "crawl_state.json",
 	}
+}
 
-	audioBody := &audioPostBody{
-		Audio: audioPostAudio{
-			Content: base64.RawURLEncoding.EncodeToString(buf.Bytes()),
-		},
-		Config: recognitionConfig{
-			LanguageCode: "en-US",
-			Model:        "video",
+// readTimeout bounds the wait for the response headers and then again the
+// reading of the body.
+func readTimeout() time.Duration {
+	if settings.ReadTimeout > 0 {
+		return time.Duration(settings.ReadTimeout) * time.Second
+	}
+	return defaultReadTimeout
+}
+
+// requestTimeout bounds a whole request, and a Chrome navigation.
+func requestTimeout() time.Duration {
+	if settings.RequestTimeout > 0 {
+		return time.Duration(settings.RequestTimeout) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+// newHTTPClient builds the client shared by every request so connections
+// are kept alive between them. Timeouts are in seconds; read_timeout bounds
+// the wait for the response headers and then the body read, request_timeout
+// the whole request. The proxy of each request is taken from its context.
+func newHTTPClient() *http.Client {
+	connectTimeout := defaultConnectTimeout
+	if settings.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(settings.ConnectTimeout) * time.Second
+	}
+	maxIdleConnsPerHost := defaultMaxIdleConnsPerHost
+	if settings.MaxIdleConnsPerHost > 0 {
+		maxIdleConnsPerHost = settings.MaxIdleConnsPerHost
+	}
+	maxRedirects := defaultMaxRedirects
+	if settings.MaxRedirects > 0 {
+		maxRedirects = settings.MaxRedirects
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			if proxy, ok := req.Context().Value(proxyKey{}).(*proxyT); ok && proxy != nil {
+				return proxy.url, nil
+			}
+			return nil, nil
 		},
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout(),
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     settings.HTTP2,
+	}
+	if !settings.HTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
 
-	reqBody, err := json.Marshal(audioBody)
+	return &http.Client{
+		Transport: transport,
+		Jar:       cookies,
+		Timeout:   requestTimeout(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("%s: stopped after %d redirects", req.URL, maxRedirects)
+			}
+			return nil
+		},
+	}
+}
 
-	// pass audio into google speech api
-	speechResp, err := http.Post("https://speech.googleapis.com/v1p1beta1/speech:recognize?key="+settings.Captcha, "application/json", bytes.NewBuffer(reqBody))
+func writeJSON() {
+	jsonData := jsonType{settings, sitemap}
+	dataJSON, err := json.MarshalIndent(jsonData, "", "  ")
+	if err != nil {
+		logErrors(err)
+	}
 
+	err = ioutil.WriteFile(configFile, dataJSON, 0644)
 	if err != nil {
-		return "", err
+		logErrors(err)
 	}
+}
 
-	defer speechResp.Body.Close()
+func selectorText(doc *goquery.Selection, selector *selectors) []string {
+	var text []string
+	var matchText *regexp2.Match
+	doc.Find(selector.Selector).EachWithBreak(
+		func(i int, s *goquery.Selection) bool {
+			if selector.Regex != "" {
+				re := regexp2.MustCompile(selector.Regex, 0)
+				matchText, _ = re.FindStringMatch(s.Text())
+				if matchText != nil {
+					text = append(text, strings.TrimSpace(matchText.String()))
+				} else {
+					text = append(text, strings.TrimSpace(s.Text()))
+				}
+			} else {
+				text = append(text, strings.TrimSpace(s.Text()))
+			}
 
-	err = json.NewDecoder(speechResp.Body).Decode(&speechBody)
+			return selector.Multiple
+		},
+	)
+	return text
+}
+
+func selectorHTML(doc *goquery.Selection, selector *selectors) []string {
+	var htmls []string
+	var matchHTML *regexp2.Match
+	doc.Find(selector.Selector).EachWithBreak(
+		func(i int, s *goquery.Selection) bool {
+			var html string
+			var err error
+			if selector.OuterHTML {
+				html, err = goquery.OuterHtml(s)
+			} else {
+				html, err = s.Html()
+			}
+			if err != nil {
+				logErrors(err)
+				return selector.Multiple
+			}
+			if selector.Regex != "" {
+				re := regexp2.MustCompile(selector.Regex, 0)
+				matchHTML, _ = re.FindStringMatch(html)
+				if matchHTML != nil {
+					htmls = append(htmls, strings.TrimSpace(matchHTML.String()))
+				} else {
+					htmls = append(htmls, strings.TrimSpace(html))
+				}
+			} else {
+				htmls = append(htmls, strings.TrimSpace(html))
+			}
+
+			return selector.Multiple
+		},
+	)
+	return htmls
+}
+
+func selectorLink(doc *goquery.Selection, selector *selectors, baseURL string) []string {
+	var links []string
+	doc.Find(selector.Selector).EachWithBreak(
+		func(i int, s *goquery.Selection) bool {
+			href, ok := s.Attr("href")
+			if !ok {
+				fmt.Println("Error: HREF has not been found.")
+			}
+
+			link, err := toFixedURL(href, baseURL)
+			if err != nil {
+				logErrors(err)
+				return selector.Multiple
+			}
+			links = append(links, link)
+
+			return selector.Multiple
+		},
+	)
+	return links
+}
+
+func selectorElementAttribute(doc *goquery.Selection, selector *selectors, attribute string) []string {
+	var links []string
+	doc.Find(selector.Selector).EachWithBreak(
+		func(i int, s *goquery.Selection) bool {
+			href, ok := s.Attr(attribute)
+			if !ok {
+				fmt.Println("Error: HREF has not been found.")
+			}
+			links = append(links, href)
+
+			return selector.Multiple
+		},
+	)
+	return links
+}
+
+// selectorElementAttributes returns one map of attribute values per matched
+// element, for selectors extracting several attributes at once.
+func selectorElementAttributes(doc *goquery.Selection, selector *selectors, attributes []string) []map[string]string {
+	var elements []map[string]string
+	doc.Find(selector.Selector).EachWithBreak(
+		func(i int, s *goquery.Selection) bool {
+			element := make(map[string]string)
+			for _, attribute := range attributes {
+				element[attribute], _ = s.Attr(attribute)
+			}
+			elements = append(elements, element)
+
+			return selector.Multiple
+		},
+	)
+	return elements
+}
+
+// extractAttributes splits the comma separated extractAttribute field.
+func extractAttributes(selector *selectors) []string {
+	var attributes []string
+	for _, attribute := range strings.Split(selector.ExtractAttribute, ",") {
+		attribute = strings.TrimSpace(attribute)
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return attributes
+}
+
+// selectorElementChildren runs every child selector of an element selector
+// inside the scope of one matched element.
+func selectorElementChildren(s *goquery.Selection, selector *selectors, pageURL, userAgent string, path linkPath) map[string]interface{} {
+	elementOutput := make(map[string]interface{})
+	for _, elementSelector := range sitemap.Selectors {
+		if elementSelector.ID != selector.ID && hasElement(elementSelector.ParentSelectors, selector.ID) {
+			result := selectorOutput(s, &elementSelector, pageURL, userAgent, path, true)
+			if result != nil {
+				elementOutput[elementSelector.ID] = result
+			}
+		}
+	}
+	return elementOutput
+}
+
+func selectorElement(doc *goquery.Selection, selector *selectors, pageURL, userAgent string, path linkPath) []interface{} {
+	var elementOutputList []interface{}
+	doc.Find(selector.Selector).EachWithBreak(
+		func(i int, s *goquery.Selection) bool {
+			elementOutput := selectorElementChildren(s, selector, pageURL, userAgent, path)
+			if len(elementOutput) != 0 {
+				elementOutputList = append(elementOutputList, elementOutput)
+			}
+
+			return selector.Multiple
+		},
+	)
+	return elementOutputList
+}
+
+// selectorElementClick opens the page in Chrome and clicks the selector's
+// click element until the limit is reached or no new elements show up.
+// "clickOnce" clicks every matching button a single time (tabs), while
+// "clickMore" keeps clicking the first one (load more buttons). Every
+// element revealed along the way is extracted once with its child selectors.
+func selectorElementClick(pageURL, userAgent string, path linkPath, selector *selectors) []interface{} {
+	ctx, cancel, proxy := newChromeContext(pageURL, userAgent)
+	defer cancel()
 
+	err := chromeVisit(ctx, pageURL, chromedp.Sleep(time.Duration(selector.Delay)*time.Millisecond))
+	proxies.report(proxy, err)
 	if err != nil {
-		return "", err
+		logErrors(err)
+		return nil
+	}
+
+	delay := time.Duration(selector.Delay) * time.Millisecond
+	if delay == 0 {
+		delay = defaultClickDelay
+	}
+
+	seen := 0
+	elementOutputList, _ := collectNewElements(ctx, selector, pageURL, userAgent, path, &seen)
+	for clicks := 0; selector.ClickLimit == 0 || clicks < selector.ClickLimit; clicks++ {
+		index := 0
+		if selector.ClickType == "clickOnce" {
+			index = clicks
+		}
+		var clicked bool
+		release := limiter.acquire(urlHost(pageURL))
+		err = chromedp.Run(ctx,
+			chromedp.Evaluate(clickScript(selector.ClickElementSelector, index), &clicked),
+		)
+		if err != nil {
+			release()
+			logErrors(err)
+			break
+		}
+		if !clicked {
+			release()
+			break
+		}
+		err = chromedp.Run(ctx, chromedp.Sleep(delay))
+		release()
+		if err != nil {
+			logErrors(err)
+			break
+		}
+		elementOutput, found := collectNewElements(ctx, selector, pageURL, userAgent, path, &seen)
+		elementOutputList = append(elementOutputList, elementOutput...)
+		if found == 0 && selector.ClickType != "clickOnce" {
+			break
+		}
+	}
+	return elementOutputList
+}
+
+// selectorElementScroll scrolls the page to the bottom, waiting the
+// selector's delay after every scroll, until no new elements are loaded or
+// the scroll limit is reached.
+func selectorElementScroll(pageURL, userAgent string, path linkPath, selector *selectors) []interface{} {
+	ctx, cancel, proxy := newChromeContext(pageURL, userAgent)
+	defer cancel()
+
+	err := chromeVisit(ctx, pageURL, chromedp.Sleep(time.Duration(selector.Delay)*time.Millisecond))
+	proxies.report(proxy, err)
+	if err != nil {
+		logErrors(err)
+		return nil
+	}
+
+	delay := time.Duration(selector.Delay) * time.Millisecond
+	if delay == 0 {
+		delay = defaultScrollDelay
+	}
+
+	seen := 0
+	elementOutputList, _ := collectNewElements(ctx, selector, pageURL, userAgent, path, &seen)
+	for scrolls := 0; selector.ScrollLimit == 0 || scrolls < selector.ScrollLimit; scrolls++ {
+		var res []byte
+		release := limiter.acquire(urlHost(pageURL))
+		err = chromedp.Run(ctx,
+			chromedp.Evaluate(`window.scrollTo(0, document.body.scrollHeight);`, &res),
+			chromedp.Sleep(delay),
+		)
+		release()
+		if err != nil {
+			logErrors(err)
+			break
+		}
+		elementOutput, found := collectNewElements(ctx, selector, pageURL, userAgent, path, &seen)
+		elementOutputList = append(elementOutputList, elementOutput...)
+		if found == 0 {
+			break
+		}
+	}
+	return elementOutputList
+}
+
+// collectNewElements extracts the child selectors of every element matched
+// in the current page that has not been seen yet. It returns the extracted
+// records and how many new elements were found. Elements are told apart by
+// marking them in the page, not by their markup, so identical elements
+// still count and replaced ones are new. Without Multiple only the first
+// element of the page is extracted, but new elements are still counted so
+// loading goes on.
+func collectNewElements(ctx context.Context, selector *selectors, pageURL, userAgent string, path linkPath, seen *int) ([]interface{}, int) {
+	var found int
+	err := chromedp.Run(ctx, chromedp.Evaluate(markNewScript(selector.Selector), &found))
+	if err != nil {
+		logErrors(err)
+		return nil, 0
+	}
+	doc, err := chromeDocument(ctx)
+	if err != nil {
+		logErrors(err)
+		return nil, 0
+	}
+	newElements := doc.Find(selector.Selector).Filter(`[` + seenAttribute + `="new"]`)
+	doc.Find(`[` + seenAttribute + `]`).RemoveAttr(seenAttribute)
+
+	var elementOutputList []interface{}
+	newElements.EachWithBreak(
+		func(i int, s *goquery.Selection) bool {
+			if !selector.Multiple && *seen+i > 0 {
+				return false
+			}
+			elementOutput := selectorElementChildren(s, selector, pageURL, userAgent, path)
+			if len(elementOutput) != 0 {
+				elementOutputList = append(elementOutputList, elementOutput)
+			}
+			return selector.Multiple
+		},
+	)
+	*seen += found
+	return elementOutputList, found
+}
+
+// seenAttribute marks the elements collectNewElements went through.
+const seenAttribute = "data-scraper-seen"
+
+// markNewScript marks the matched elements not seen before as "new", the
+// ones marked "new" by the previous pass becoming "old", and returns how
+// many new elements there are.
+func markNewScript(elementSelector string) string {
+	quoted, _ := json.Marshal(elementSelector)
+	return fmt.Sprintf(`(function() {
+		document.querySelectorAll('[%[2]s="new"]').forEach(function(el) {
+			el.setAttribute("%[2]s", "old");
+		});
+		var found = 0;
+		document.querySelectorAll(%[1]s).forEach(function(el) {
+			if (!el.hasAttribute("%[2]s")) {
+				el.setAttribute("%[2]s", "new");
+				found++;
+			}
+		});
+		return found;
+	})()`, quoted, seenAttribute)
+}
+
+// selectorPopupLink clicks every matched element in Chrome and records the
+// URL of the window it opens. Popups are closed once their URL is known.
+func selectorPopupLink(pageURL, userAgent string, selector *selectors) []string {
+	ctx, cancel, proxy := newChromeContext(pageURL, userAgent)
+	defer cancel()
+
+	err := chromeVisit(ctx, pageURL, chromedp.Sleep(time.Duration(selector.Delay)*time.Millisecond))
+	proxies.report(proxy, err)
+	if err != nil {
+		logErrors(err)
+		return nil
+	}
+
+	var count int
+	quoted, _ := json.Marshal(selector.Selector)
+	err = chromedp.Run(ctx,
+		chromedp.Evaluate(fmt.Sprintf(`document.querySelectorAll(%s).length`, quoted), &count),
+	)
+	if err != nil {
+		logErrors(err)
+		return nil
+	}
+	if !selector.Multiple && count > 1 {
+		count = 1
+	}
+
+	var links []string
+	for i := 0; i < count; i++ {
+		release := limiter.acquire(urlHost(pageURL))
+		popupURL, err := openPopup(ctx, proxy, selector.Selector, i)
+		release()
+		if err != nil {
+			logErrors(err)
+			continue
+		}
+		links = append(links, popupURL)
+	}
+	return links
+}
+
+func openPopup(ctx context.Context, proxy *proxyT, popupSelector string, index int) (string, error) {
+	waitCtx, waitCancel := context.WithTimeout(ctx, popupTimeout)
+	defer waitCancel()
+	ch := chromedp.WaitNewTarget(waitCtx, func(info *target.Info) bool {
+		return info.URL != "" && info.URL != "about:blank"
+	})
+
+	var clicked bool
+	err := chromedp.Run(ctx, chromedp.Evaluate(clickScript(popupSelector, index), &clicked))
+	if err != nil {
+		return "", err
+	}
+	if !clicked {
+		return "", fmt.Errorf("popup element %d of %s not found", index, popupSelector)
+	}
+
+	var targetID target.ID
+	select {
+	case targetID = <-ch:
+	case <-waitCtx.Done():
+		return "", fmt.Errorf("no popup opened by element %d of %s", index, popupSelector)
+	}
+
+	// cancelling the popup context closes its window
+	popupCtx, popupCancel := chromedp.NewContext(ctx, chromedp.WithTargetID(targetID))
+	defer popupCancel()
+	err = chromeProxyAuth(popupCtx, proxy)
+	if err != nil {
+		return "", err
+	}
+	var popupURL string
+	err = chromedp.Run(popupCtx, chromedp.Location(&popupURL))
+	return popupURL, err
+}
+
+func clickScript(clickSelector string, index int) string {
+	quoted, _ := json.Marshal(clickSelector)
+	return fmt.Sprintf(`(function() {
+		var el = document.querySelectorAll(%s)[%d];
+		if (!el) {
+			return false;
+		}
+		el.scrollIntoView();
+		el.click();
+		return true;
+	})()`, quoted, index)
+}
+
+// selectorGroup collects every matched element into a single record, one
+// object per element holding its text and, optionally, an attribute.
+func selectorGroup(doc *goquery.Selection, selector *selectors) []map[string]string {
+	var group []map[string]string
+	doc.Find(selector.Selector).Each(func(i int, s *goquery.Selection) {
+		record := make(map[string]string)
+		record[selector.ID] = strings.TrimSpace(s.Text())
+		if selector.ExtractAttribute != "" {
+			attribute, _ := s.Attr(selector.ExtractAttribute)
+			record[selector.ID+"-"+selector.ExtractAttribute] = attribute
+		}
+		group = append(group, record)
+	})
+	return group
+}
+
+func selectorImage(doc *goquery.Selection, selector *selectors) []string {
+	var sources []string
+	doc.Find(selector.Selector).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		src, ok := s.Attr("src")
+		if !ok {
+			fmt.Println("Error: HREF has not been found.")
+		}
+		sources = append(sources, src)
+
+		return selector.Multiple
+	})
+	return sources
+}
+
+func selectorTable(doc *goquery.Selection, selector *selectors) map[string]interface{} {
+	var headings, row []string
+	var rows = [][]string{}
+	table := make(map[string]interface{})
+	doc.Find(selector.Selector).Each(func(_ int, tableHTML *goquery.Selection) {
+		tableHTML.Find("tr").Each(func(_ int, rowHTML *goquery.Selection) {
+			rowHTML.Find("th").Each(func(_ int, tableHeading *goquery.Selection) {
+				headings = append(headings, tableHeading.Text())
+			})
+			rowHTML.Find("td").Each(func(_ int, tableCell *goquery.Selection) {
+				row = append(row, tableCell.Text())
+			})
+			if len(row) != 0 {
+				rows = append(rows, row)
+				row = nil
+			}
+		})
+	})
+	table["header"] = headings
+	table["rows"] = rows
+	return table
+}
+
+func parseCatchAudio(url string) (string, error) {
+	var speechBody speechRecognitionResponse
+	// Get the data
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	buf := new(bytes.Buffer)
+
+	// Write the audio body to the buffer
+	_, err = io.Copy(buf, resp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	audioBody := &audioPostBody{
+		Audio: audioPostAudio{
+			Content: base64.RawURLEncoding.EncodeToString(buf.Bytes()),
+		},
+		Config: recognitionConfig{
+			LanguageCode: "en-US",
+			Model:        "video",
+		},
+	}
+
+	reqBody, err := json.Marshal(audioBody)
+
+	// pass audio into google speech api
+	speechResp, err := http.Post("https://speech.googleapis.com/v1p1beta1/speech:recognize?key="+settings.Captcha, "application/json", bytes.NewBuffer(reqBody))
+
+	if err != nil {
+		return "", err
+	}
+
+	defer speechResp.Body.Close()
+
+	err = json.NewDecoder(speechResp.Body).Decode(&speechBody)
+
+	if err != nil {
+		return "", err
+	}
+
+	return speechBody.Result[0].Alternatives[0].Transcript, nil
+}
+
+func crawlURL(href, userAgent string) (*goquery.Document, error) {
+	body, err := fetchURL(href, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	return goquery.NewDocumentFromReader(bytes.NewReader(body))
+}
+
+// revalidateURL fetches a page in incremental mode. A page of the
+// previous run is requested with its ETag and Last-Modified, and when it
+// was not modified its stored body is parsed instead.
+func revalidateURL(href, userAgent string) (*goquery.Document, error) {
+	previous, conditional := changes.lookup(href)
+	var body []byte
+	header := http.Header{}
+	err := withRetries(href, func() error {
+		ctx := context.WithValue(crawlCtx, headerKey{}, &header)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, href, nil)
+		if err != nil {
+			return err
+		}
+		if conditional {
+			if previous.ETag != "" {
+				req.Header.Set("If-None-Match", previous.ETag)
+			}
+			if previous.LastModified != "" {
+				req.Header.Set("If-Modified-Since", previous.LastModified)
+			}
+		}
+		body, err = sendRequest(req, userAgent)
+		return err
+	})
+	var statusErr *httpError
+	if conditional && errors.As(err, &statusErr) && statusErr.statusCode == http.StatusNotModified {
+		fmt.Println("Not modified:", href)
+		body, err = previous.body()
+		if err != nil {
+			return nil, err
+		}
+		changes.validate(href, previous.ETag, previous.LastModified, body)
+		return goquery.NewDocumentFromReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	changes.validate(href, header.Get("ETag"), header.Get("Last-Modified"), body)
+	return goquery.NewDocumentFromReader(bytes.NewReader(body))
+}
+
+func fetchURL(href, userAgent string) ([]byte, error) {
+	var body []byte
+	err := withRetries(href, func() error {
+		var err error
+		body, err = requestURL(href, userAgent)
+		return err
+	})
+	return body, err
+}
+
+func requestURL(href, userAgent string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(crawlCtx, http.MethodGet, href, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sendRequest(req, userAgent)
+}
+
+// sendRequest sends req through the proxy pool and the rate limiter of its
+// host.
+func sendRequest(req *http.Request, userAgent string) ([]byte, error) {
+	proxy := proxies.get(req.URL.Hostname())
+	release := limiter.acquire(req.URL.Hostname())
+	defer release()
+	body, err := doRequest(req, userAgent, proxy)
+	proxies.report(proxy, err)
+	return body, err
+}
+
+func doRequest(req *http.Request, userAgent string, proxy *proxyT) ([]byte, error) {
+	href := req.URL.String()
+	ctx, cancel := context.WithCancel(context.WithValue(req.Context(), proxyKey{}, proxy))
+	defer cancel()
+	req = req.WithContext(ctx)
+	if len(userAgent) > 0 {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	for key, value := range requestHeaders(userAgent) {
+		if req.Header.Get(key) == "" {
+			req.Header.Set(key, value)
+		}
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if header, ok := req.Context().Value(headerKey{}).(*http.Header); ok {
+		*header = response.Header
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, &httpError{
+			url:        href,
+			statusCode: response.StatusCode,
+			retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+		}
+	}
+	timeout := readTimeout()
+	timer := time.AfterFunc(timeout, cancel)
+	body, err := readBody(href, response.Body)
+	if !timer.Stop() {
+		// context.DeadlineExceeded is a timeout, so the read is retried
+		return nil, fmt.Errorf("%s: body not read within %s: %w", href, timeout, context.DeadlineExceeded)
+	}
+	return body, err
+}
+
+// readBody reads a response body, refusing bodies larger than the
+// configured maximum.
+func readBody(href string, body io.Reader) ([]byte, error) {
+	if settings.MaxBodySize <= 0 {
+		return ioutil.ReadAll(body)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, settings.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > settings.MaxBodySize {
+		return nil, fmt.Errorf("%s: body larger than %d bytes", href, settings.MaxBodySize)
+	}
+	return data, nil
+}
+
+// crawlRequest fetches a page with the method, body and headers of a start
+// request.
+func crawlRequest(href string, pageReq *pageRequest, userAgent string) (*goquery.Document, error) {
+	var body []byte
+	err := withRetries(href, func() error {
+		req, err := http.NewRequestWithContext(crawlCtx, pageReq.method, href, bytes.NewReader(pageReq.body))
+		if err != nil {
+			return err
+		}
+		if pageReq.contentType != "" {
+			req.Header.Set("Content-Type", pageReq.contentType)
+		}
+		for key, value := range pageReq.headers {
+			req.Header.Set(key, value)
+		}
+		body, err = sendRequest(req, userAgent)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return goquery.NewDocumentFromReader(bytes.NewReader(body))
+}
+
+// expandStartRequest returns the jobs of a start request, one per value of
+// its iterated parameter. With FormFromPage the values are posted one
+// after the other instead, see postback.
+func expandStartRequest(start startRequest, index int, parent string, siteMap *scraping) ([]workerJob, error) {
+	values := []string{""}
+	if start.Iterate != nil {
+		var err error
+		values, err = iterateValues(start.Iterate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if start.FormFromPage {
+		page, err := crawlURL(start.URL, agents.get(urlHost(start.URL)))
+		if err != nil {
+			return nil, err
+		}
+		job, err := newStartJob(start, hiddenInputs(page, `input[type="hidden"]`), values[0], parent, siteMap)
+		if err != nil {
+			return nil, err
+		}
+		job.request.chain = &postback{start: start, index: index, values: values}
+		return []workerJob{job}, nil
+	}
+	var jobs []workerJob
+	for _, value := range values {
+		job, err := newStartJob(start, url.Values{}, value, parent, siteMap)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// newStartJob returns the job sending a start request with form, the
+// hidden inputs of the page, and value as its iterated parameter. GET and
+// HEAD requests carry the form in their query string.
+func newStartJob(start startRequest, form url.Values, value, parent string, siteMap *scraping) (workerJob, error) {
+	method := strings.ToUpper(start.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	job := workerJob{
+		startURL: start.URL,
+		request:  &pageRequest{method: method, headers: start.Headers},
+		depth:    siteMap.depth,
+		parent:   parent,
+		siteMap:  siteMap,
+	}
+	if start.JSON != nil {
+		if method == http.MethodGet || method == http.MethodHead {
+			return job, fmt.Errorf("%s: a %s start request cannot send JSON", start.URL, method)
+		}
+		data := start.JSON
+		if start.Iterate != nil {
+			if object, ok := start.JSON.(map[string]interface{}); ok {
+				copied := make(map[string]interface{})
+				for key, field := range object {
+					copied[key] = field
+				}
+				copied[start.Iterate.Param] = iterateValue(fmt.Sprint(object[start.Iterate.Param]), value)
+				data = copied
+			}
+		}
+		body, err := json.Marshal(data)
+		if err != nil {
+			return job, err
+		}
+		job.request.body = body
+		job.request.contentType = "application/json"
+		return job, nil
+	}
+	body := url.Values{}
+	for key := range form {
+		body.Set(key, form.Get(key))
+	}
+	for key, field := range start.Form {
+		body.Set(key, field)
+	}
+	if start.Iterate != nil {
+		body.Set(start.Iterate.Param, iterateValue(start.Form[start.Iterate.Param], value))
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		uri, err := url.Parse(start.URL)
+		if err != nil {
+			return job, err
+		}
+		query := uri.Query()
+		for key := range body {
+			query.Set(key, body.Get(key))
+		}
+		uri.RawQuery = query.Encode()
+		job.startURL = uri.String()
+		return job, nil
+	}
+	job.request.body = []byte(body.Encode())
+	job.request.contentType = "application/x-www-form-urlencoded"
+	return job, nil
+}
+
+// nextPostback returns the job posting the next value of a FormFromPage
+// start request, built from the hidden inputs of the page doc the current
+// value returned.
+func nextPostback(job workerJob, doc *goquery.Document) (workerJob, bool) {
+	if job.request == nil || job.request.chain == nil {
+		return workerJob{}, false
+	}
+	chain := job.request.chain
+	if chain.position+1 >= len(chain.values) {
+		return workerJob{}, false
+	}
+	next, err := newStartJob(chain.start, hiddenInputs(doc, `input[type="hidden"]`), chain.values[chain.position+1], job.parent, job.siteMap)
+	if err != nil {
+		logErrors(err)
+		return workerJob{}, false
+	}
+	next.request.chain = &postback{
+		start:    chain.start,
+		index:    chain.index,
+		values:   chain.values,
+		position: chain.position + 1,
+	}
+	return next, true
+}
+
+func iterateValue(template, value string) string {
+	if strings.Contains(template, "{value}") {
+		return strings.Replace(template, "{value}", value, -1)
+	}
+	return value
+}
+
+// iterateValues returns Values, or the values of Range written like a
+// start URL range without the brackets: "1-20", "0-100:10" or "001-100".
+func iterateValues(iterate *iterateParam) ([]string, error) {
+	if len(iterate.Values) != 0 {
+		return iterate.Values, nil
+	}
+	template := "[" + strings.Replace(iterate.Range, " ", "", -1) + "]"
+	match, _ := urlTemplate.FindStringMatch(template)
+	if match == nil || match.Index != 0 || match.Length != len([]rune(template)) {
+		return nil, fmt.Errorf("invalid range %q", iterate.Range)
+	}
+	values := templateValues(match)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("empty range %q", iterate.Range)
+	}
+	return values, nil
+}
+
+// hiddenInputs collects the name and value of the inputs matching selector.
+func hiddenInputs(doc *goquery.Document, selector string) url.Values {
+	values := url.Values{}
+	doc.Find(selector).Each(func(i int, s *goquery.Selection) {
+		name, ok := s.Attr("name")
+		if ok {
+			value, _ := s.Attr("value")
+			values.Set(name, value)
+		}
+	})
+	return values
+}
+
+// jobKey identifies a page in the output. Start requests are told apart by
+// their method and body as they often share the same URL.
+func jobKey(job workerJob) string {
+	if job.request == nil {
+		return job.startURL
+	}
+	return job.request.method + " " + job.startURL + " " + string(job.request.body)
+}
+
+// postForm posts a login form. It is not retried, posting the
+// credentials twice could log in twice or lock the account.
+func postForm(href string, values url.Values, userAgent string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(crawlCtx, http.MethodPost, href, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return sendRequest(req, userAgent)
+}
+
+// login runs the login block of the sitemap. The session ends up in the
+// cookie jar, which both the HTTP client and Chrome use.
+func login() error {
+	loginBlock := sitemap.Login
+	if loginBlock == nil {
+		return nil
+	}
+	userAgent := agents.get(urlHost(loginBlock.URL))
+	var doc *goquery.Document
+	var err error
+	switch loginBlock.Type {
+	case "form":
+		doc, err = formLogin(loginBlock, userAgent)
+	case "chrome":
+		doc, err = chromeLogin(loginBlock, userAgent)
+	default:
+		return fmt.Errorf("unknown login type %q", loginBlock.Type)
+	}
+	if err != nil {
+		return err
+	}
+	if loginBlock.SuccessSelector != "" && doc.Find(loginBlock.SuccessSelector).Length() == 0 {
+		return fmt.Errorf("login failed: %s not found after logging in at %s", loginBlock.SuccessSelector, loginBlock.URL)
+	}
+	fmt.Println("Logged in:", loginBlock.URL)
+	return nil
+}
+
+// formLogin loads the login page for its cookies and hidden inputs, CSRF
+// tokens included, then posts them along with the configured fields.
+func formLogin(loginBlock *loginT, userAgent string) (*goquery.Document, error) {
+	page, err := crawlURL(loginBlock.URL, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	csrfSelector := loginBlock.CSRFSelector
+	if csrfSelector == "" {
+		csrfSelector = `input[type="hidden"]`
+	}
+	values := hiddenInputs(page, csrfSelector)
+	for name, value := range loginBlock.Fields {
+		values.Set(name, value)
+	}
+
+	action := loginBlock.Action
+	if action == "" {
+		action, _ = page.Find("form").First().Attr("action")
+	}
+	action, err = toFixedURL(action, loginBlock.URL)
+	if err != nil {
+		return nil, err
+	}
+	body, err := postForm(action, values, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	return goquery.NewDocumentFromReader(bytes.NewReader(body))
+}
+
+// chromeLogin runs the login steps in Chrome and copies the resulting
+// cookies into the jar.
+func chromeLogin(loginBlock *loginT, userAgent string) (*goquery.Document, error) {
+	ctx, cancel, proxy := newChromeContext(loginBlock.URL, userAgent)
+	defer cancel()
+	ctx, timeoutCancel := context.WithTimeout(ctx, loginTimeout)
+	defer timeoutCancel()
+
+	var actions []chromedp.Action
+	for _, step := range loginBlock.Steps {
+		switch step.Action {
+		case "fill":
+			actions = append(actions,
+				chromedp.WaitVisible(step.Selector, chromedp.ByQuery),
+				chromedp.Clear(step.Selector, chromedp.ByQuery),
+				chromedp.SendKeys(step.Selector, step.Value, chromedp.ByQuery),
+			)
+		case "click":
+			actions = append(actions, chromedp.Click(step.Selector, chromedp.ByQuery, chromedp.NodeVisible))
+		case "wait":
+			actions = append(actions, chromedp.WaitVisible(step.Selector, chromedp.ByQuery))
+		case "sleep":
+			milliseconds, _ := strconv.Atoi(step.Value)
+			actions = append(actions, chromedp.Sleep(time.Duration(milliseconds)*time.Millisecond))
+		default:
+			return nil, fmt.Errorf("unknown login step %q", step.Action)
+		}
+	}
+	if loginBlock.SuccessSelector != "" {
+		actions = append(actions, chromedp.WaitReady(loginBlock.SuccessSelector, chromedp.ByQuery))
+	}
+	err := chromeNavigate(ctx, loginBlock.URL, actions...)
+	proxies.report(proxy, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var chromeCookies []*network.Cookie
+	err = chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		var err error
+		chromeCookies, err = network.GetAllCookies().Do(ctx)
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	for _, cookie := range chromeCookies {
+		if cookie.Session {
+			cookie.Expires = 0
+		}
+		cookies.add(storedCookie{
+			Domain:         cookie.Domain,
+			HostOnly:       !strings.HasPrefix(cookie.Domain, "."),
+			Path:           cookie.Path,
+			Secure:         cookie.Secure,
+			HTTPOnly:       cookie.HTTPOnly,
+			Session:        cookie.Session,
+			ExpirationDate: cookie.Expires,
+			Name:           cookie.Name,
+			Value:          cookie.Value,
+		})
+	}
+	return chromeDocument(ctx)
+}
+
+func loginGeneration() int {
+	session.Lock()
+	defer session.Unlock()
+	return session.generation
+}
+
+// relogin logs in again unless another worker already did since the
+// session seen by the caller expired.
+func relogin(generation int) error {
+	session.Lock()
+	defer session.Unlock()
+	if session.generation != generation {
+		return nil
+	}
+	err := login()
+	if err != nil {
+		return err
+	}
+	session.generation++
+	return nil
+}
+
+// sessionExpired reports whether doc shows the sitemap's session expired
+// marker.
+func sessionExpired(doc *goquery.Document) bool {
+	loginBlock := sitemap.Login
+	return loginBlock != nil && loginBlock.ExpiredSelector != "" && doc.Find(loginBlock.ExpiredSelector).Length() != 0
+}
+
+// withRetries calls fetch until it succeeds, fails permanently or the
+// configured number of retries is used up, backing off exponentially with
+// jitter between attempts.
+func withRetries(href string, fetch func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fetch()
+		if err == nil || attempt >= settings.Retries || !retryable(err) {
+			return err
+		}
+		wait := retryDelay(attempt, err)
+		logErrors(fmt.Errorf("retrying %s in %s: %v", href, wait, err))
+		select {
+		case <-time.After(wait):
+		case <-crawlCtx.Done():
+			return err
+		}
+	}
+}
+
+// retryable reports whether err is a transient failure: a timeout, a reset
+// connection, a 429 or a 5xx response.
+func retryable(err error) bool {
+	var statusErr *httpError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryDelay(attempt int, err error) time.Duration {
+	var statusErr *httpError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		return statusErr.retryAfter
+	}
+	delay := defaultRetryDelay
+	if settings.RetryDelay > 0 {
+		delay = time.Duration(settings.RetryDelay) * time.Millisecond
+	}
+	maxDelay := defaultRetryMaxDelay
+	if settings.RetryMaxDelay > 0 {
+		maxDelay = time.Duration(settings.RetryMaxDelay) * time.Millisecond
+	}
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	// equal jitter: half of the delay is fixed, the other half random
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// fetchErrorOutput is the record written for a page that could not be
+// scraped.
+func fetchErrorOutput(err error) map[string]interface{} {
+	output := map[string]interface{}{
+		"_error": err.Error(),
+	}
+	var statusErr *httpError
+	if errors.As(err, &statusErr) {
+		output["_status"] = statusErr.statusCode
+	}
+	return output
+}
+
+// getRobots returns the robots.txt rules of the page's host, fetching them
+// the first time the host is seen.
+func getRobots(pageURL string) *robotsRules {
+	robotsURL, err := toFixedURL("/robots.txt", pageURL)
+	if err != nil {
+		logErrors(err)
+		return &robotsRules{}
+	}
+	robots.Lock()
+	rules, ok := robots.hosts[robotsURL]
+	if !ok {
+		rules = &robotsRules{}
+		robots.hosts[robotsURL] = rules
+	}
+	robots.Unlock()
+
+	rules.once.Do(func() {
+		body, err := fetchURL(robotsURL, agents.get(urlHost(robotsURL)))
+		if err != nil {
+			// a missing robots.txt allows everything, an unreachable
+			// one disallows everything
+			var statusErr *httpError
+			if !errors.As(err, &statusErr) || statusErr.statusCode >= 500 {
+				logErrors(err)
+				rules.disallowAll = true
+			}
+			return
+		}
+		parseRobots(rules, body)
+		limiter.crawlDelay(urlHost(robotsURL), rules.crawlDelay)
+	})
+	return rules
+}
+
+// parseRobots reads the groups applying to every user agent along with the
+// sitemaps declared in a robots.txt.
+func parseRobots(rules *robotsRules, body []byte) {
+	applies := false
+	inRules := false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.Index(line, "#"); comment != -1 {
+			line = line[:comment]
+		}
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+		switch key {
+		case "user-agent":
+			// consecutive user-agent lines share the rules below them
+			if inRules {
+				applies = false
+				inRules = false
+			}
+			if value == "*" {
+				applies = true
+			}
+		case "allow", "disallow":
+			inRules = true
+			if applies && value != "" {
+				pattern := regexp2.Escape(value)
+				pattern = strings.Replace(pattern, `\*`, ".*", -1)
+				if strings.HasSuffix(pattern, `\$`) {
+					pattern = strings.TrimSuffix(pattern, `\$`) + "$"
+				}
+				re, err := regexp2.Compile("^"+pattern, 0)
+				if err != nil {
+					logErrors(err)
+					continue
+				}
+				rules.rules = append(rules.rules, robotsRule{allow: key == "allow", pattern: value, re: re})
+			}
+		case "crawl-delay":
+			inRules = true
+			if applies {
+				seconds, err := strconv.ParseFloat(value, 64)
+				if err == nil {
+					rules.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		case "sitemap":
+			rules.sitemaps = append(rules.sitemaps, value)
+		}
+	}
+}
+
+// robotsAllowed reports whether robots.txt lets us fetch pageURL. The
+// longest matching rule wins, allow rules winning ties.
+func robotsAllowed(pageURL string) bool {
+	if settings.IgnoreRobots {
+		return true
+	}
+	uri, err := url.Parse(pageURL)
+	if err != nil {
+		return false
+	}
+	rules := getRobots(pageURL)
+	if rules.disallowAll {
+		return false
+	}
+	path := uri.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if uri.RawQuery != "" {
+		path += "?" + uri.RawQuery
+	}
+	allowed := true
+	longest := -1
+	for _, rule := range rules.rules {
+		if ok, _ := rule.re.MatchString(path); !ok {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			longest = len(rule.pattern)
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+// robotsSitemaps returns the sitemaps declared in the robots.txt of the
+// page's host, falling back to the conventional /sitemap.xml.
+func robotsSitemaps(pageURL string) []string {
+	sitemaps := getRobots(pageURL).sitemaps
+	if len(sitemaps) == 0 {
+		sitemapURL, _ := toFixedURL("/sitemap.xml", pageURL)
+		sitemaps = append(sitemaps, sitemapURL)
+	}
+	return sitemaps
+}
+
+func (r *runReport) skipRobots(pageURL string) {
+	r.Lock()
+	defer r.Unlock()
+	r.robotsSkipped = append(r.robotsSkipped, pageURL)
+	logErrors(fmt.Errorf("skipped by robots.txt: %s", pageURL))
+}
+
+func (r *runReport) filterURL(reason string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.filtered == nil {
+		r.filtered = make(map[string]int)
+	}
+	r.filtered[reason]++
+}
+
+// summary prints the run report.
+func (r *runReport) summary() {
+	r.Lock()
+	defer r.Unlock()
+	fmt.Println("Skipped by robots.txt:", len(r.robotsSkipped))
+	for _, pageURL := range r.robotsSkipped {
+		fmt.Println("  ", pageURL)
+	}
+	fmt.Println("Beyond max depth:", r.filtered["depth"])
+	fmt.Println("Outside allowed domains:", r.filtered["domain"])
+	fmt.Println("Filtered by URL rules:", r.filtered["pattern"])
+}
+
+func newCrawlScope(siteMap *scraping) *crawlScope {
+	c := &crawlScope{
+		maxDepth: siteMap.MaxDepth,
+	}
+	for _, domain := range siteMap.AllowedDomains {
+		domain = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(domain), "*"), ".")
+		if domain != "" {
+			c.domains = append(c.domains, domain)
+		}
+	}
+	for _, pattern := range siteMap.IncludeURLs {
+		re, err := urlPattern(pattern)
+		if err != nil {
+			logErrors(err)
+			continue
+		}
+		c.include = append(c.include, re)
+	}
+	for _, pattern := range siteMap.ExcludeURLs {
+		re, err := urlPattern(pattern)
+		if err != nil {
+			logErrors(err)
+			continue
+		}
+		c.exclude = append(c.exclude, re)
+	}
+	return c
+}
+
+// urlPattern compiles an include or exclude rule. Rules between slashes,
+// "/page=\d+/", are regular expressions matching anywhere in the URL;
+// anything else is a glob matching the whole URL, where "*" matches any
+// characters and "?" a single one.
+func urlPattern(pattern string) (*regexp2.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp2.Compile(pattern[1:len(pattern)-1], 0)
+	}
+	expr := "^"
+	for _, char := range pattern {
+		switch char {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		default:
+			expr += regexp2.Escape(string(char))
+		}
+	}
+	return regexp2.Compile(expr+"$", 0)
+}
+
+func matchAny(patterns []*regexp2.Regexp, pageURL string) bool {
+	for _, re := range patterns {
+		isMatch, _ := re.MatchString(pageURL)
+		if isMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns why a job is out of scope: "depth", "domain" or
+// "pattern", or "" when it may be dispatched.
+func (c *crawlScope) filter(job workerJob) string {
+	if c.maxDepth > 0 && job.depth > c.maxDepth {
+		return "depth"
+	}
+	if len(c.domains) != 0 {
+		host := strings.ToLower(urlHost(job.startURL))
+		allowed := false
+		for _, domain := range c.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "domain"
+		}
+	}
+	if len(c.include) != 0 && !matchAny(c.include, job.startURL) {
+		return "pattern"
+	}
+	if matchAny(c.exclude, job.startURL) {
+		return "pattern"
+	}
+	return ""
+}
+
+// sitemapXMLLinks fetches a sitemap.xml, gzipped or not, and returns its
+// page locations. Sitemap index files are followed recursively.
+func sitemapXMLLinks(sitemapURL, userAgent string, re *regexp2.Regexp, visited map[string]bool) []string {
+	var links []string
+	if visited[sitemapURL] {
+		return links
+	}
+	visited[sitemapURL] = true
+
+	body, err := fetchURL(sitemapURL, userAgent)
+	if err != nil {
+		logErrors(err)
+		return links
+	}
+	if len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			logErrors(err)
+			return links
+		}
+		// readBody caps the decompressed size too, a small gzip can
+		// expand to gigabytes.
+		body, err = readBody(sitemapURL, reader)
+		if err != nil {
+			logErrors(err)
+			return links
+		}
+	}
+
+	var data sitemapXML
+	err = xml.Unmarshal(body, &data)
+	if err != nil {
+		logErrors(err)
+		return links
+	}
+	for _, child := range data.Sitemaps {
+		links = append(links, sitemapXMLLinks(strings.TrimSpace(child.Loc), userAgent, re, visited)...)
+	}
+	for _, page := range data.URLs {
+		loc := strings.TrimSpace(page.Loc)
+		if re != nil {
+			if ok, _ := re.MatchString(loc); !ok {
+				continue
+			}
+		}
+		links = append(links, loc)
+	}
+	return links
+}
+
+func selectorSitemapXMLLink(pageURL, userAgent string, selector *selectors) []string {
+	var re *regexp2.Regexp
+	if selector.FoundURLRegex != "" {
+		var err error
+		re, err = regexp2.Compile(selector.FoundURLRegex, 0)
+		if err != nil {
+			logErrors(err)
+			return nil
+		}
+	}
+	sitemapURLs := selector.SitemapXMLURLs
+	if len(sitemapURLs) == 0 {
+		sitemapURLs = robotsSitemaps(pageURL)
+	}
+	var links []string
+	visited := make(map[string]bool)
+	for _, sitemapURL := range sitemapURLs {
+		sitemapURL, err := toFixedURL(sitemapURL, pageURL)
+		if err != nil {
+			logErrors(err)
+			continue
+		}
+		links = append(links, sitemapXMLLinks(sitemapURL, userAgent, re, visited)...)
+	}
+	return links
+}
+
+func toFixedURL(href, baseURL string) (string, error) {
+	uri, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	toFixedURI := base.ResolveReference(uri)
+	return toFixedURI.String(), nil
+}
+
+func getSiteMap(startURL []string, selector *selectors) *scraping {
+	baseSiteMap := sitemap
+	newSiteMap := new(scraping)
+	*newSiteMap = baseSiteMap
+	newSiteMap.ID = selector.ID
+	newSiteMap.StartURL = startURL
+	newSiteMap.StartRequests = nil
+	return newSiteMap
+}
+
+func getChildSelector(selector *selectors) bool {
+	count := 0
+	for _, childSelector := range sitemap.Selectors {
+		if childSelector.ID != selector.ID && hasElement(childSelector.ParentSelectors, selector.ID) {
+			count++
+		}
+	}
+
+	return count == 0
+}
+
+// selectorDelay is the politeness pause before requesting a page reached
+// through the given selector.
+func selectorDelay(siteMap *scraping, id string) time.Duration {
+	for _, selector := range siteMap.Selectors {
+		if selector.ID == id {
+			return time.Duration(selector.Delay) * time.Millisecond
+		}
+	}
+	return 0
+}
+
+// pageDelay is how long a rendered page is left to settle before
+// extraction: the longest delay of the selectors that run on it.
+func pageDelay(siteMap *scraping, parent string) time.Duration {
+	var delay time.Duration
+	for _, selector := range siteMap.Selectors {
+		if hasElement(selector.ParentSelectors, parent) {
+			if d := time.Duration(selector.Delay) * time.Millisecond; d > delay {
+				delay = d
+			}
+		}
+	}
+	return delay
+}
+
+func hasElement(s interface{}, elem interface{}) bool {
+	arrV := reflect.ValueOf(s)
+	if arrV.Kind() == reflect.Slice {
+		for i := 0; i < arrV.Len(); i++ {
+			if arrV.Index(i).Interface() == elem {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func chromeOptions(userAgent string, proxy *proxyT) []chromedp.ExecAllocatorOption {
+	opts := append([]chromedp.ExecAllocatorOption{}, chromedp.DefaultExecAllocatorOptions[:]...)
+	if proxy != nil {
+		// Chrome takes the credentials through the Fetch domain, see
+		// newChromeContext
+		proxyServer := *proxy.url
+		proxyServer.User = nil
+		opts = append(opts, chromedp.ProxyServer(proxyServer.String()))
+	}
+	if len(userAgent) > 0 {
+		opts = append(opts, chromedp.UserAgent(userAgent))
+	}
+	return opts
+}
+
+// newChromeContext starts a Chrome session for pageURL through the next
+// proxy of the pool. Chrome cannot authenticate to socks5 proxies, so
+// credentials only work with http and https ones.
+func newChromeContext(pageURL, userAgent string) (context.Context, context.CancelFunc, *proxyT) {
+	proxy := proxies.get(urlHost(pageURL))
+	bCtx, bCancel := chromedp.NewExecAllocator(crawlCtx, chromeOptions(userAgent, proxy)...)
+	ctx, cancel := chromedp.NewContext(bCtx)
+	cancelAll := func() {
+		cancel()
+		bCancel()
+	}
+	headers := network.Headers{}
+	for key, value := range requestHeaders(userAgent) {
+		headers[key] = value
+	}
+	actions := []chromedp.Action{network.Enable(), network.SetExtraHTTPHeaders(headers)}
+	if chromeCookies := chromeCookies(); len(chromeCookies) > 0 {
+		actions = append(actions, network.SetCookies(chromeCookies))
+	}
+	err := chromedp.Run(ctx, actions...)
+	if err != nil {
+		logErrors(err)
+	}
+	err = chromeProxyAuth(ctx, proxy)
+	if err != nil {
+		logErrors(err)
+	}
+	return ctx, cancelAll, proxy
+}
+
+// chromeProxyAuth answers the proxy's credential challenges on the target
+// of ctx. Every target needs it, popups included.
+func chromeProxyAuth(ctx context.Context, proxy *proxyT) error {
+	if proxy == nil || proxy.url.User == nil {
+		return nil
+	}
+	username := proxy.url.User.Username()
+	password, _ := proxy.url.User.Password()
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *fetch.EventAuthRequired:
+			go func() {
+				_ = chromedp.Run(ctx, fetch.ContinueWithAuth(ev.RequestID, &fetch.AuthChallengeResponse{
+					Response: fetch.AuthChallengeResponseResponseProvideCredentials,
+					Username: username,
+					Password: password,
+				}))
+			}()
+		case *fetch.EventRequestPaused:
+			go func() {
+				_ = chromedp.Run(ctx, fetch.ContinueRequest(ev.RequestID))
+			}()
+		}
+	})
+	return chromedp.Run(ctx, fetch.Enable().WithHandleAuthRequests(true))
+}
+
+// chromeNavigate loads pageURL in the session, then runs actions. It holds
+// one of the host's rate limiter slots only while doing so: extraction may
+// fetch more pages of the same host while the session is still open. Like
+// an HTTP request it fails with a timeout after the request timeout, so a
+// page that never loads gets retried.
+func chromeNavigate(ctx context.Context, pageURL string, actions ...chromedp.Action) error {
+	release := limiter.acquire(urlHost(pageURL))
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout())
+	defer cancel()
+	return chromedp.Run(ctx, append([]chromedp.Action{chromedp.Navigate(pageURL)}, actions...)...)
+}
+
+// chromeVisit navigates like chromeNavigate for the Chrome sessions of
+// click, scroll and popup selectors, which the worker's session check does
+// not see. When the page shows the session expired marker it logs in
+// again, hands Chrome the new cookies and reloads the page.
+func chromeVisit(ctx context.Context, pageURL string, actions ...chromedp.Action) error {
+	generation := loginGeneration()
+	err := chromeNavigate(ctx, pageURL, actions...)
+	if err != nil || sitemap.Login == nil || sitemap.Login.ExpiredSelector == "" {
+		return err
+	}
+	doc, err := chromeDocument(ctx)
+	if err != nil || !sessionExpired(doc) {
+		return err
+	}
+	err = relogin(generation)
+	if err != nil {
+		return err
+	}
+	if chromeCookies := chromeCookies(); len(chromeCookies) > 0 {
+		err = chromedp.Run(ctx, network.SetCookies(chromeCookies))
+		if err != nil {
+			return err
+		}
+	}
+	return chromeNavigate(ctx, pageURL, actions...)
+}
+
+func chromeDocument(ctx context.Context) (*goquery.Document, error) {
+	var body string
+	err := chromedp.Run(ctx,
+		chromedp.InnerHTML(`body`, &body, chromedp.NodeVisible, chromedp.ByQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return goquery.NewDocumentFromReader(strings.NewReader(body))
+}
+
+func emulateURL(url, userAgent string) (*goquery.Document, error) {
+	ctx, cancel, proxy := newChromeContext(url, userAgent)
+	defer cancel()
+	err := chromeNavigate(ctx, url)
+	proxies.report(proxy, err)
+	if err != nil {
+		return nil, err
+	}
+	return chromeDocument(ctx)
+}
+
+func navigateURL(url, userAgent string, delay time.Duration) (*goquery.Document, error) {
+	ctx, cancel, proxy := newChromeContext(url, userAgent)
+	defer cancel()
+
+	var checkboxNode *target.Info
+	var challengeNode *target.Info
+
+	// only pages showing a captcha wait for its iframe
+	var captcha bool
+	err := chromeNavigate(ctx, url,
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		chromedp.Evaluate(`document.querySelector('iframe[src*="recaptcha"]') !== null`, &captcha),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			if !captcha {
+				return nil
+			}
+			return chromedp.WaitReady(`iframe[src*="recaptcha"]`, chromedp.ByQuery).Do(ctx)
+		}),
+	)
+	proxies.report(proxy, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// need to get captcha iframe targets ou4t
+	var targets []*target.Info
+	if captcha {
+		targets, _ = chromedp.Targets(ctx)
+	}
+
+	for _, t := range targets {
+		if t.Type == "iframe" && strings.Contains(t.URL, "anchor") {
+			checkboxNode = t
+		}
+		if t.Type == "iframe" && strings.Contains(t.URL, "bframe") {
+			challengeNode = t
+		}
+	}
+
+	if checkboxNode != nil {
+		err = solveCaptcha(ctx, checkboxNode, challengeNode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var body string
+	bodyCtx, bodyCancel := context.WithTimeout(ctx, delay+requestTimeout())
+	defer bodyCancel()
+	err = chromedp.Run(bodyCtx,
+		chromedp.Sleep(delay),
+		chromedp.InnerHTML(`body`, &body, chromedp.ByQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r := strings.NewReader(body)
+	return goquery.NewDocumentFromReader(r)
+}
+
+func solveCaptcha(ctx context.Context, checkboxNode, challengeNode *target.Info) error {
+	// set context to captcha checkbox iframe
+	ictx, cancel := chromedp.NewContext(ctx, chromedp.WithTargetID(checkboxNode.TargetID))
+	defer cancel()
+
+	var ok bool
+	var checked string
+
+	err := chromedp.Run(
+		ctx,
+		chromedp.WaitVisible(`#recaptcha-anchor`, chromedp.NodeVisible),
+		chromedp.Click(`#recaptcha-anchor`, chromedp.ByID),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = chromedp.Run(
+		ictx,
+		chromedp.AttributeValue(`#recaptcha-anchor`, "aria-checked", &checked, &ok),
+	)
+	if err != nil {
+		return err
+	}
+
+	isCheched, _ := strconv.ParseBool(checked)
+
+	if !isCheched && challengeNode != nil {
+		var audioSource string
+		ictx2, cancel := chromedp.NewContext(ctx, chromedp.WithTargetID(challengeNode.TargetID))
+		defer cancel()
+
+		err = chromedp.Run(
+			ictx2,
+			chromedp.WaitVisible(`#recaptcha-audio-button`, chromedp.ByID),
+			chromedp.Click(`#recaptcha-audio-button`, chromedp.NodeVisible),
+			chromedp.WaitVisible(`#audio-response`, chromedp.ByID),
+			chromedp.AttributeValue(`#audio-source`, "src", &audioSource, &ok),
+		)
+		if err != nil {
+			return err
+		}
+
+		if audioSource != "" {
+			text, err := parseCatchAudio(audioSource)
+			if err != nil {
+				return err
+			}
+
+			err = chromedp.Run(
+				ictx2,
+				chromedp.WaitVisible(`#audio-response`, chromedp.ByID),
+				chromedp.SetValue(`#audio-response`, text, chromedp.ByID),
+				chromedp.Click(`#recaptcha-verify-button`, chromedp.NodeVisible),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newChangeStore() *changeStore {
+	c := &changeStore{
+		enabled:    settings.Incremental,
+		previous:   make(map[string]pageState),
+		current:    make(map[string]pageState),
+		linked:     make(map[string]pageState),
+		validators: make(map[string]pageState),
+	}
+	if !c.enabled || settings.IncrementalFile == "" {
+		return c
+	}
+	data, err := ioutil.ReadFile(settings.IncrementalFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrors(err)
+		}
+		return c
+	}
+	state := changeState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		logErrors(err)
+		return c
+	}
+	if state.Pages != nil {
+		c.previous = state.Pages
+	}
+	if state.Linked != nil {
+		c.linked = state.Linked
+	}
+	if resume && state.Current != nil {
+		c.current = state.Current
+	}
+	return c
+}
+
+// lookup returns the page as of the previous run, if it can be
+// revalidated: it has validators and a stored body to scrape again.
+func (c *changeStore) lookup(href string) (pageState, bool) {
+	c.Lock()
+	defer c.Unlock()
+	page, ok := c.previous[href]
+	if !ok {
+		page, ok = c.linked[href]
+	}
+	return page, ok && (page.ETag != "" || page.LastModified != "") && len(page.Body) != 0
+}
+
+// validate keeps the validators a page was served with and its body.
+func (c *changeStore) validate(href, etag, lastModified string, body []byte) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write(body)
+	if err == nil {
+		err = writer.Close()
+	}
+	page := pageState{ETag: etag, LastModified: lastModified}
+	if err != nil {
+		logErrors(err)
+	} else {
+		page.Body = compressed.Bytes()
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.validators[href] = page
+}
+
+// body returns the page body stored by validate.
+func (p pageState) body() ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(p.Body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// record keeps the state of a root page and reports whether its record has
+// to be written, tagging it with a "_change" of "new" or "changed".
+func (c *changeStore) record(job workerJob) bool {
+	key := jobKey(job)
+	c.Lock()
+	defer c.Unlock()
+	previous, seen := c.previous[key]
+	if _, failed := job.linkOutput["_error"]; failed {
+		// Keep the page as it was, it will be compared again next run.
+		if seen {
+			c.current[key] = previous
+		}
+		return true
+	}
+	data, _ := json.Marshal(job.linkOutput)
+	sum := sha256.Sum256(data)
+	page := c.validators[job.startURL]
+	// What is left in validators are the linked pages.
+	delete(c.validators, job.startURL)
+	page.Hash = hex.EncodeToString(sum[:])
+	c.current[key] = page
+	if len(job.linkOutput) == 0 || (seen && previous.Hash == page.Hash) {
+		return false
+	}
+	if seen {
+		job.linkOutput["_change"] = "changed"
+	} else {
+		job.linkOutput["_change"] = "new"
+	}
+	return true
+}
+
+// removed returns the root pages of the previous run that were not found
+// again.
+func (c *changeStore) removed() []string {
+	c.Lock()
+	defer c.Unlock()
+	var keys []string
+	for key := range c.previous {
+		if _, ok := c.current[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save writes the incremental file. After a complete run the pages found
+// become the ones the next run compares with; an interrupted run keeps
+// the previous pages and saves its progress for --resume.
+func (c *changeStore) save() {
+	c.write(!interrupted())
+}
+
+// saveProgress writes the progress of a run still going on, along with
+// the checkpoint, so a run that is killed can be resumed too.
+func (c *changeStore) saveProgress() {
+	c.write(false)
+}
+
+func (c *changeStore) write(complete bool) {
+	if !c.enabled || settings.IncrementalFile == "" {
+		return
+	}
+	c.Lock()
+	state := changeState{Pages: c.current, Linked: c.validators}
+	if !complete {
+		linked := make(map[string]pageState)
+		for href, page := range c.linked {
+			linked[href] = page
+		}
+		for href, page := range c.validators {
+			linked[href] = page
+		}
+		state = changeState{Pages: c.previous, Current: c.current, Linked: linked}
+	}
+	data, err := json.Marshal(state)
+	c.Unlock()
+	if err != nil {
+		logErrors(err)
+		return
+	}
+	err = writeFileAtomic(settings.IncrementalFile, data, 0644)
+	if err != nil {
+		logErrors(err)
+	}
+}
+
+// urlTemplate matches the ranges of a start URL, "[1-100]", "[0-100:10]"
+// and zero padded "[001-100]", and its value lists, "{red,blue,green}".
+var urlTemplate = regexp2.MustCompile(`\[(\d{1,10})-(\d{1,10})(?::(\d{1,10}))?\]|\{([^{}]*,[^{}]*)\}`, 0)
+
+func getURL(urls []string) <-chan string {
+	c := make(chan string)
+	go func() {
+		for _, urlLink := range urls {
+			expandURL(urlLink, func(pageURL string) {
+				c <- pageURL
+			})
+		}
+		close(c)
+	}()
+	return c
+}
+
+// expandURL calls emit with every URL of a template, taking the cartesian
+// product when it has several ranges or lists.
+func expandURL(template string, emit func(string)) {
+	match, _ := urlTemplate.FindStringMatch(template)
+	if match == nil {
+		emit(template)
+		return
+	}
+	// regexp2 reports positions in runes, not bytes.
+	runes := []rune(template)
+	prefix := string(runes[:match.Index])
+	rest := string(runes[match.Index+match.Length:])
+	for _, value := range templateValues(match) {
+		expandURL(rest, func(suffix string) {
+			emit(prefix + value + suffix)
+		})
+	}
+}
+
+// templateValues returns the values of a single range or list.
+func templateValues(match *regexp2.Match) []string {
+	groups := match.Groups()
+	if list := groups[4].String(); groups[4].Length > 0 {
+		return strings.Split(list, ",")
+	}
+	from, to := groups[1].String(), groups[2].String()
+	int1, _ := strconv.Atoi(from)
+	int2, _ := strconv.Atoi(to)
+	step := 1
+	if groups[3].Length > 0 {
+		step, _ = strconv.Atoi(groups[3].String())
+		if step < 1 {
+			step = 1
+		}
+	}
+	format := "%d"
+	if len(from) > 1 && strings.HasPrefix(from, "0") {
+		format = fmt.Sprintf("%%0%dd", len(from))
+	}
+	var values []string
+	for x := int1; x <= int2; x += step {
+		values = append(values, fmt.Sprintf(format, x))
+	}
+	return values
+}
+
+// countURLs returns how many URLs the templates expand to.
+func countURLs(urls []string) int {
+	total := 0
+	for _, urlLink := range urls {
+		count := 1
+		template := urlLink
+		for {
+			match, _ := urlTemplate.FindStringMatch(template)
+			if match == nil {
+				break
+			}
+			count *= len(templateValues(match))
+			template = string([]rune(template)[match.Index+match.Length:])
+		}
+		total += count
+	}
+	return total
+}
+
+// countRequests returns how many start pages a sitemap will request.
+func countRequests(siteMap *scraping) int {
+	total := countURLs(siteMap.StartURL)
+	for _, start := range siteMap.StartRequests {
+		if start.Iterate == nil {
+			total++
+			continue
+		}
+		values, err := iterateValues(start.Iterate)
+		if err == nil {
+			total += len(values)
+		}
+	}
+	return total
+}
+
+// fetchPage fetches the page of a job. Start requests with a body are
+// always sent over HTTP, even in JavaScript mode.
+func fetchPage(job workerJob, userAgent string) (*goquery.Document, error) {
+	var doc *goquery.Document
+	var err error
+	if job.request != nil {
+		pause(selectorDelay(job.siteMap, job.parent))
+		doc, err = crawlRequest(job.startURL, job.request, userAgent)
+	} else if settings.JavaScript {
+		err = withRetries(job.startURL, func() error {
+			doc, err = navigateURL(job.startURL, userAgent, pageDelay(job.siteMap, job.parent))
+			return err
+		})
+	} else if changes.enabled {
+		pause(selectorDelay(job.siteMap, job.parent))
+		doc, err = revalidateURL(job.startURL, userAgent)
+	} else {
+		pause(selectorDelay(job.siteMap, job.parent))
+		doc, err = crawlURL(job.startURL, userAgent)
+	}
+	return doc, err
+}
+
+func worker(jobs <-chan workerJob, results chan<- workerJob, frontier *urlFrontier, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for job := range jobs {
+		if interrupted() {
+			// Still queued when the crawl was stopped, a root page is
+			// pending in the checkpoint.
+			frontier.done()
+			continue
+		}
+		if job.parent != "_root" {
+			output, scraped, claimed := pages.claim(job)
+			if scraped {
+				job.linkOutput = output
+				results <- job
+				frontier.done()
+				continue
+			}
+			job.claimed = claimed
+		}
+		userAgent := agents.get(urlHost(job.startURL))
+		generation := loginGeneration()
+		doc, err := fetchPage(job, userAgent)
+		if err == nil && sessionExpired(doc) {
+			err = relogin(generation)
+			if err == nil {
+				doc, err = fetchPage(job, userAgent)
+			}
+		}
+		if err != nil {
+			logErrors(err)
+			job.linkOutput = fetchErrorOutput(err)
+			results <- job
+			frontier.done()
+			continue
+		}
+		if next, ok := nextPostback(job, doc); ok {
+			frontier.add(next)
+		}
+		fmt.Println("URL:", job.startURL)
+		linkOutput := make(map[string]interface{})
+		path := job.linkPath()
+		for _, selector := range job.siteMap.Selectors {
+			if hasElement(selector.ParentSelectors, job.parent) {
+				if selector.Type == "SelectorLink" && hasElement(selector.ParentSelectors, selector.ID) {
+					links := selectorLink(doc.Selection, &selector, job.startURL)
+					for _, link := range links {
+						frontier.add(workerJob{
+							parent:   job.parent,
+							startURL: link,
+							depth:    job.depth,
+							siteMap:  job.siteMap,
+						})
+					}
+				} else {
+					result := selectorOutput(doc.Selection, &selector, job.startURL, userAgent, path, false)
+					if result != nil {
+						linkOutput[selector.ID] = result
+					}
+				}
+			}
+		}
+		job.linkOutput = linkOutput
+		job.partial = *path.stopped
+		results <- job
+		frontier.done()
+	}
+}
+
+// selectorOutput runs a selector inside the given scope and returns its
+// value. Text, HTML and image values are nil when nothing matched, while
+// attributes and elements are always lists and links always a list or a
+// record, as they have always been. Element selectors recurse into their
+// children and link selectors with children scrape the linked pages, so
+// any selector type can be nested under any other.
+//
+// Click, scroll and popup selectors drive a Chrome session on the whole
+// page. Nested inside an element their page has already been rendered by
+// the parent, so click and scroll act as plain element selectors and popup
+// links fall back to the href of the matched elements.
+func selectorOutput(doc *goquery.Selection, selector *selectors, pageURL, userAgent string, path linkPath, nested bool) interface{} {
+	switch selector.Type {
+	case "SelectorText":
+		return singleOrList(selectorText(doc, selector))
+	case "SelectorHTML":
+		return singleOrList(selectorHTML(doc, selector))
+	case "SelectorImage":
+		return singleOrList(selectorImage(doc, selector))
+	case "SelectorElementAttribute":
+		attributes := extractAttributes(selector)
+		if len(attributes) > 1 {
+			return selectorElementAttributes(doc, selector, attributes)
+		}
+		attribute := ""
+		if len(attributes) == 1 {
+			attribute = attributes[0]
+		}
+		return selectorElementAttribute(doc, selector, attribute)
+	case "SelectorLink":
+		return followLinks(selectorLink(doc, selector, pageURL), selector, path)
+	case "SelectorSitemapXmlLink":
+		return followLinks(selectorSitemapXMLLink(pageURL, userAgent, selector), selector, path)
+	case "SelectorPopupLink":
+		if nested {
+			return followLinks(selectorLink(doc, selector, pageURL), selector, path)
+		}
+		return followLinks(selectorPopupLink(pageURL, userAgent, selector), selector, path)
+	case "SelectorGroup":
+		resultGroup := selectorGroup(doc, selector)
+		if len(resultGroup) != 0 {
+			return resultGroup
+		}
+	case "SelectorTable":
+		return selectorTable(doc, selector)
+	case "SelectorElement":
+		return selectorElement(doc, selector, pageURL, userAgent, path)
+	case "SelectorElementClick":
+		if nested {
+			return selectorElement(doc, selector, pageURL, userAgent, path)
+		}
+		return selectorElementClick(pageURL, userAgent, path, selector)
+	case "SelectorElementScroll":
+		if nested {
+			return selectorElement(doc, selector, pageURL, userAgent, path)
+		}
+		return selectorElementScroll(pageURL, userAgent, path, selector)
+	}
+	return nil
+}
+
+// followLinks scrapes the linked pages with the selector's children, or
+// returns the links themselves when it has none. path is the link path of
+// the page the links are on.
+func followLinks(links []string, selector *selectors, path linkPath) interface{} {
+	childSelector := getChildSelector(selector)
+	if childSelector == true {
+		return links
+	}
+	if len(links) == 0 {
+		return map[string]interface{}{}
+	}
+	newSiteMap := getSiteMap(links, selector)
+	newSiteMap.depth = path.depth + 1
+	newSiteMap.ancestors = path.pages
+	output, stopped := scraper(newSiteMap, selector.ID)
+	if stopped {
+		*path.stopped = true
+	}
+	return output
+}
+
+func singleOrList(values []string) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+// scraper scrapes the start pages of siteMap and the pages they paginate
+// to with the selectors of parent. stopped is whether the crawl was
+// stopped before every one of them was scraped.
+func scraper(siteMap *scraping, parent string) (output map[string]interface{}, stopped bool) {
+	var wg sync.WaitGroup
+	jobs := make(chan workerJob, settings.Workers)
+	results := make(chan workerJob, settings.Workers)
+	outputChannel := make(chan map[string]interface{})
+	frontier := newFrontier()
+	for x := 1; x <= settings.Workers; x++ {
+		wg.Add(1)
+		go worker(jobs, results, frontier, &wg)
+	}
+	if parent == "_root" && resume {
+		state, err := loadCheckpoint()
+		if err != nil && !os.IsNotExist(err) {
+			logErrors(err)
+		}
+		frontier.restore(state, parent, siteMap)
+	}
+	stopCheckpoints := make(chan struct{})
+	// watchers are done once stopCheckpoints is closed.
+	var watchers sync.WaitGroup
+	if parent == "_root" && settings.CheckpointFile != "" {
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			checkpoints(frontier, stopCheckpoints)
+		}()
+	}
+	watchers.Add(1)
+	go func() {
+		defer watchers.Done()
+		select {
+		case <-stopping:
+			frontier.stop()
+		case <-stopCheckpoints:
+		}
+	}()
+	frontier.hold()
+	go func() {
+		defer frontier.done()
+		for startURL := range getURL(siteMap.StartURL) {
+			frontier.add(workerJob{
+				parent:   parent,
+				startURL: startURL,
+				depth:    siteMap.depth,
+				siteMap:  siteMap,
+			})
+		}
+		for index, start := range siteMap.StartRequests {
+			if !validURL(start.URL) {
+				continue
+			}
+			if !robotsAllowed(start.URL) {
+				report.skipRobots(start.URL)
+				continue
+			}
+			startJobs, err := expandStartRequest(start, index, parent, siteMap)
+			if err != nil {
+				logErrors(err)
+				continue
+			}
+			for _, startJob := range startJobs {
+				frontier.add(startJob)
+			}
+		}
+	}()
+	go func() {
+		for {
+			job, ok := frontier.next()
+			if !ok {
+				break
+			}
+			if !validURL(job.startURL) {
+				frontier.complete(job)
+				frontier.done()
+				continue
+			}
+			if reason := scope.filter(job); reason != "" {
+				report.filterURL(reason)
+				frontier.complete(job)
+				frontier.done()
+				continue
+			}
+			if job.request == nil && !robotsAllowed(job.startURL) {
+				report.skipRobots(job.startURL)
+				frontier.complete(job)
+				frontier.done()
+				continue
+			}
+			select {
+			case jobs <- job:
+			case <-stopping:
+				// Left running in the frontier, so a root page is pending
+				// in the checkpoint.
+				frontier.done()
+			}
+		}
+		close(jobs)
+	}()
+	go func() {
+		pageOutput := make(map[string]interface{})
+		for job := range results {
+			if job.claimed {
+				pages.finish(job)
+			}
+			if job.partial || parent == "_root" && crawlCtx.Err() != nil {
+				// Stopped while its linked pages were being scraped, or
+				// aborted by the shutdown timeout, the output is partial.
+				// The page stays pending, for --resume and for the
+				// scraper of the page linking to it.
+				continue
+			}
+			if job.parent == "_root" {
+				writeRecord(frontier, job)
+				continue
+			}
+			if len(job.linkOutput) != 0 {
+				pageOutput[jobKey(job)] = job.linkOutput
+			}
+			frontier.complete(job)
+		}
+		outputChannel <- pageOutput
+	}()
+	wg.Wait()
+	close(results)
+	output = <-outputChannel
+	stopped = frontier.unfinished()
+	close(stopCheckpoints)
+	watchers.Wait()
+	if parent == "_root" && changes.enabled && !interrupted() {
+		for _, key := range changes.removed() {
+			err := exportResult(key, map[string]interface{}{"_change": "removed"})
+			if err != nil {
+				logErrors(err)
+			}
+		}
+	}
+	if parent == "_root" && settings.CheckpointFile != "" {
+		if interrupted() {
+			saveCheckpoint(frontier)
+		} else {
+			// The frontier is drained, there is nothing left to resume.
+			err := os.Remove(settings.CheckpointFile)
+			if err != nil && !os.IsNotExist(err) {
+				logErrors(err)
+			}
+		}
+	}
+	return output, stopped
+}
+
+// writeRecord writes the output of a root page and marks the page
+// complete in one go for the checkpoints, which would otherwise list a
+// page already in the output file as pending and --resume would write it
+// twice.
+func writeRecord(frontier *urlFrontier, job workerJob) {
+	frontier.saving.Lock()
+	defer frontier.saving.Unlock()
+	if changes.enabled && !changes.record(job) {
+		frontier.complete(job)
+		return
+	}
+	if len(job.linkOutput) != 0 {
+		err := exportResult(jobKey(job), job.linkOutput)
+		if err != nil {
+			logErrors(err)
+		}
+	}
+	frontier.complete(job)
+}
+
+// exportResult adds the output of a root page to the output file.
+func exportResult(startURL string, linkOutput map[string]interface{}) error {
+	out, err := ioutil.ReadFile(settings.OutputFile)
+	if err != nil {
+		return err
+	}
+	var data = map[string]interface{}{}
+	_ = json.Unmarshal(out, &data)
+	data[startURL] = linkOutput
+	switch settings.Export {
+	case "xml":
+		output, err := xml.MarshalIndent(data, "", " ")
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(settings.OutputFile, output, 0644)
+	case "csv":
+		csvFile, err := os.OpenFile(settings.OutputFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		csvWriter := csv.NewWriter(csvFile)
+		var rows [][]string
+		for i, v := range data {
+			rows = append(rows, []string{i, fmt.Sprint(v)})
+		}
+		for _, row := range rows {
+			err = csvWriter.Write(row)
+			if err != nil {
+				frontendLog(err)
+				break
+			}
+		}
+		csvWriter.Flush()
+		return csvFile.Close()
+	case "json":
+		output, err := json.MarshalIndent(data, "", " ")
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(settings.OutputFile, output, 0644)
+	default:
+		fmt.Println("Error: Please choose an output format.")
 	}
-
-	return speechBody.Result[0].Alternatives[0].Transcript, nil
+	return nil
 }
 
-func crawlURL(href, userAgent string) *goquery.Document {
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
-	}
-
-	if len(settings.Proxy) > 0 {
-		proxyString := settings.Proxy[0]
-		proxyURL, _ := url.Parse(proxyString)
-		transport.Proxy = http.ProxyURL(proxyURL)
-	}
+// trackingParams are query parameters that only tell analytics where a
+// visitor came from and are left out when comparing URLs.
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"msclkid": true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_ga":     true,
+}
 
-	netClient := &http.Client{Transport: transport}
-	req, err := http.NewRequest(http.MethodGet, href, nil)
+// normalizeURL returns the canonical form of a URL used to tell whether a
+// page was already seen: lowercased scheme and host without the default
+// port, sorted query without tracking parameters and no fragment.
+func normalizeURL(href string) string {
+	uri, err := url.Parse(href)
 	if err != nil {
-		logErrors(err)
-		os.Exit(1)
+		return href
 	}
-	if len(userAgent) > 0 {
-		req.Header.Set("User-Agent", userAgent)
+	uri.Scheme = strings.ToLower(uri.Scheme)
+	uri.Host = strings.ToLower(uri.Host)
+	if (uri.Scheme == "http" && uri.Port() == "80") || (uri.Scheme == "https" && uri.Port() == "443") {
+		uri.Host = uri.Hostname()
 	}
-	response, err := netClient.Do(req)
-	if err != nil {
-		logErrors(err)
-		os.Exit(1)
+	if uri.Path == "" {
+		uri.Path = "/"
 	}
-
-	doc, err := goquery.NewDocumentFromReader(response.Body)
-
-	err = response.Body.Close()
-
-	if err != nil {
-		frontendLog(err)
+	uri.Fragment = ""
+	query := uri.Query()
+	for key := range query {
+		if trackingParams[strings.ToLower(key)] || strings.HasPrefix(strings.ToLower(key), "utm_") {
+			query.Del(key)
+		}
 	}
-	return doc
+	uri.RawQuery = query.Encode()
+	return uri.String()
 }
 
-func toFixedURL(href, baseURL string) string {
-	uri, err := url.Parse(href)
-	if err != nil {
-		logErrors(err)
-		os.Exit(0)
-	}
-	base, err := url.Parse(baseURL)
-	if err != nil {
-		logErrors(err)
-		os.Exit(0)
+func newFrontier() *urlFrontier {
+	frontier := &urlFrontier{
+		seen:      make(map[string]bool),
+		running:   make(map[string]workerJob),
+		completed: make(map[string]bool),
 	}
-	toFixedURI := base.ResolveReference(uri)
-	return toFixedURI.String()
+	frontier.cond = sync.NewCond(frontier)
+	return frontier
 }
 
-func getSiteMap(startURL []string, selector *selectors) *scraping {
-	baseSiteMap := sitemap
-	newSiteMap := new(scraping)
-	newSiteMap.ID = selector.ID
-	newSiteMap.StartURL = startURL
-	newSiteMap.Selectors = baseSiteMap.Selectors
-	return newSiteMap
+func newCrawledPages() *crawledPages {
+	pages := &crawledPages{
+		scraping: make(map[string]bool),
+		waiting:  make(map[string]map[string]int),
+		outputs:  make(map[string]map[string]interface{}),
+	}
+	pages.cond = sync.NewCond(pages)
+	return pages
 }
 
-func getChildSelector(selector *selectors) bool {
-	count := 0
-	for _, childSelector := range sitemap.Selectors {
-		if selector.ID == childSelector.ParentSelectors[0] {
-			count++
+// claim returns the output of a nested page scraped earlier, waiting for
+// it while another worker scrapes it, or false when the caller has to
+// scrape the page. The caller that claimed the page then calls finish,
+// one scraping it again to avoid a deadlock does not.
+func (p *crawledPages) claim(job workerJob) (output map[string]interface{}, scraped, claimed bool) {
+	key := pageKey(job)
+	ancestors := job.siteMap.ancestors
+	p.Lock()
+	defer p.Unlock()
+	for {
+		if output, ok := p.outputs[key]; ok {
+			return output, true, false
+		}
+		if !p.scraping[key] {
+			p.scraping[key] = true
+			return nil, false, true
+		}
+		if p.waitsFor(key, ancestors) {
+			return nil, false, false
+		}
+		for _, ancestor := range ancestors {
+			if p.waiting[ancestor] == nil {
+				p.waiting[ancestor] = make(map[string]int)
+			}
+			p.waiting[ancestor][key]++
+		}
+		p.cond.Wait()
+		for _, ancestor := range ancestors {
+			p.waiting[ancestor][key]--
+			if p.waiting[ancestor][key] == 0 {
+				delete(p.waiting[ancestor], key)
+			}
+			if len(p.waiting[ancestor]) == 0 {
+				delete(p.waiting, ancestor)
+			}
 		}
 	}
-
-	return count == 0
 }
 
-func hasElement(s interface{}, elem interface{}) bool {
-	arrV := reflect.ValueOf(s)
-	if arrV.Kind() == reflect.Slice {
-		for i := 0; i < arrV.Len(); i++ {
-			if arrV.Index(i).Interface() == elem {
-				return true
+// waitsFor reports whether the scraping of key waits, directly or through
+// other pages, for one of pages. The caller must hold the lock.
+func (p *crawledPages) waitsFor(key string, pages []string) bool {
+	onPath := make(map[string]bool)
+	for _, page := range pages {
+		onPath[page] = true
+	}
+	visited := map[string]bool{key: true}
+	queue := []string{key}
+	for len(queue) != 0 {
+		page := queue[0]
+		queue = queue[1:]
+		if onPath[page] {
+			return true
+		}
+		for next := range p.waiting[page] {
+			if !visited[next] {
+				visited[next] = true
+				queue = append(queue, next)
 			}
 		}
 	}
 	return false
 }
 
-func emulateURL(url, userAgent string) *goquery.Document {
-	var opts []func(*chromedp.ExecAllocator)
-	if len(settings.Proxy) > 0 {
-		proxyString := settings.Proxy[0]
-		proxyServer := chromedp.ProxyServer(proxyString)
-		opts = append(chromedp.DefaultExecAllocatorOptions[:], proxyServer)
-	} else {
-		opts = append(chromedp.DefaultExecAllocatorOptions[:])
+// finish keeps the output of a nested page for the records linking to it
+// and wakes those waiting for it. Pages that failed or were stopped are
+// scraped again by the next record linking to them.
+func (p *crawledPages) finish(job workerJob) {
+	key := pageKey(job)
+	p.Lock()
+	defer p.Unlock()
+	delete(p.scraping, key)
+	p.cond.Broadcast()
+	if _, failed := job.linkOutput["_error"]; failed || job.partial {
+		return
 	}
-	if len(userAgent) > 0 {
-		opts = append(opts, chromedp.UserAgent(userAgent))
+	if _, ok := p.outputs[key]; !ok {
+		p.order = append(p.order, key)
+		if len(p.order) > pageCacheSize {
+			delete(p.outputs, p.order[0])
+			p.order = p.order[1:]
+		}
 	}
-	bCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
-	ctx, _ := chromedp.NewContext(bCtx)
-	defer cancel()
-	var err error
-	var body string
-	err = chromedp.Run(ctx,
-		chromedp.Navigate(url),
-		chromedp.InnerHTML(`body`, &body, chromedp.NodeVisible, chromedp.ByQuery),
-	)
-	r := strings.NewReader(body)
-	doc, err := goquery.NewDocumentFromReader(r)
-	if err != nil {
-		logErrors(err)
-		os.Exit(0)
+	output := job.linkOutput
+	if output == nil {
+		output = map[string]interface{}{}
 	}
-	return doc
+	p.outputs[key] = output
 }
 
-func navigateURL(url, userAgent string) *goquery.Document {
-	var opts []func(*chromedp.ExecAllocator)
-	if len(settings.Proxy) > 0 {
-		proxyString := settings.Proxy[0]
-		proxyServer := chromedp.ProxyServer(proxyString)
-		opts = append(chromedp.DefaultExecAllocatorOptions[:], proxyServer)
-	} else {
-		opts = append(chromedp.DefaultExecAllocatorOptions[:])
-	}
-	if len(userAgent) > 0 {
-		opts = append(opts, chromedp.UserAgent(userAgent))
+// onPath reports whether the page of job is one of the pages linking to
+// it.
+func (p *crawledPages) onPath(job workerJob) bool {
+	key := pageKey(job)
+	for _, ancestor := range job.siteMap.ancestors {
+		if ancestor == key {
+			return true
+		}
 	}
+	return false
+}
 
-	bCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
-	ctx, cancel := chromedp.NewContext(bCtx)
+// pageKey identifies a page scraped by a selector across the run.
+func pageKey(job workerJob) string {
+	return job.parent + " " + frontierKey(job)
+}
 
-	defer cancel()
+// linkPath returns the path of the pages linked from the page of job.
+func (job workerJob) linkPath() linkPath {
+	path := linkPath{depth: job.depth, stopped: new(bool)}
+	path.pages = append(path.pages, job.siteMap.ancestors...)
+	path.pages = append(path.pages, pageKey(job))
+	return path
+}
 
-	var checkboxNode *target.Info
-	var challengeNode *target.Info
+func frontierKey(job workerJob) string {
+	key := normalizeURL(job.startURL)
+	if job.request != nil {
+		key = job.request.method + " " + key + " " + string(job.request.body)
+	}
+	return key
+}
 
-	err := chromedp.Run(ctx,
-		chromedp.Navigate(url),
-		chromedp.WaitReady("iframe", chromedp.ByQuery),
-	)
+// add queues a job unless its page was already seen or links back to a
+// page on its own link path, and reports whether it was queued.
+func (f *urlFrontier) add(job workerJob) bool {
+	key := frontierKey(job)
+	f.Lock()
+	defer f.Unlock()
+	if f.seen[key] || pages.onPath(job) {
+		return false
+	}
+	f.seen[key] = true
+	f.queue = append(f.queue, job)
+	f.active++
+	f.cond.Signal()
+	return true
+}
 
-	if err != nil {
-		logErrors(err)
-		os.Exit(0)
+// next waits for a job and returns false once the frontier is drained.
+func (f *urlFrontier) next() (workerJob, bool) {
+	f.Lock()
+	defer f.Unlock()
+	for len(f.queue) == 0 && f.active > 0 && !f.stopped {
+		f.cond.Wait()
 	}
+	if len(f.queue) == 0 || f.stopped {
+		return workerJob{}, false
+	}
+	job := f.queue[0]
+	f.queue = f.queue[1:]
+	f.running[frontierKey(job)] = job
+	return job, true
+}
 
-	// need to get captcha iframe targets ou4t
-	targets, _ := chromedp.Targets(ctx)
+// complete records that a job needs no fetching again, because its output
+// was written or it was filtered out.
+func (f *urlFrontier) complete(job workerJob) {
+	key := frontierKey(job)
+	f.Lock()
+	defer f.Unlock()
+	delete(f.running, key)
+	f.completed[key] = true
+}
 
-	for _, t := range targets {
-		if t.Type == "iframe" && strings.Contains(t.URL, "anchor") {
-			checkboxNode = t
+// snapshot returns the state to save in the checkpoint file.
+func (f *urlFrontier) snapshot() checkpointState {
+	f.Lock()
+	defer f.Unlock()
+	state := checkpointState{}
+	for key := range f.seen {
+		state.Seen = append(state.Seen, key)
+	}
+	for key := range f.completed {
+		state.Completed = append(state.Completed, key)
+	}
+	for _, job := range f.running {
+		state.Pending = append(state.Pending, newCheckpointJob(job))
+	}
+	for _, job := range f.queue {
+		state.Pending = append(state.Pending, newCheckpointJob(job))
+	}
+	return state
+}
+
+// restore fills the frontier from a checkpoint, queueing the pages that
+// were pending when it was saved.
+func (f *urlFrontier) restore(state checkpointState, parent string, siteMap *scraping) {
+	f.Lock()
+	defer f.Unlock()
+	for _, key := range state.Seen {
+		f.seen[key] = true
+	}
+	for _, key := range state.Completed {
+		f.completed[key] = true
+	}
+	for _, pending := range state.Pending {
+		job := workerJob{
+			startURL: pending.URL,
+			depth:    pending.Depth,
+			parent:   parent,
+			siteMap:  siteMap,
 		}
-		if t.Type == "iframe" && strings.Contains(t.URL, "bframe") {
-			challengeNode = t
+		if pending.Method != "" {
+			job.request = &pageRequest{
+				method:      pending.Method,
+				body:        []byte(pending.Body),
+				contentType: pending.ContentType,
+				headers:     pending.Headers,
+			}
+			if pending.StartRequest > 0 && pending.StartRequest <= len(siteMap.StartRequests) {
+				start := siteMap.StartRequests[pending.StartRequest-1]
+				values := []string{""}
+				var err error
+				if start.Iterate != nil {
+					values, err = iterateValues(start.Iterate)
+				}
+				if err == nil && pending.Value < len(values) {
+					job.request.chain = &postback{
+						start:    start,
+						index:    pending.StartRequest - 1,
+						values:   values,
+						position: pending.Value,
+					}
+				}
+			}
 		}
+		key := frontierKey(job)
+		if f.completed[key] {
+			continue
+		}
+		f.seen[key] = true
+		f.queue = append(f.queue, job)
+		f.active++
 	}
-	// set context to captcha checkbox iframe
-	ictx, _ := chromedp.NewContext(ctx, chromedp.WithTargetID(checkboxNode.TargetID))
-
-	var ok bool
-	var checked string
+}
 
-	err = chromedp.Run(
-		ctx,
-		chromedp.WaitVisible(`#recaptcha-anchor`, chromedp.NodeVisible),
-		chromedp.Click(`#recaptcha-anchor`, chromedp.ByID),
-	)
+func newCheckpointJob(job workerJob) checkpointJob {
+	pending := checkpointJob{URL: job.startURL, Depth: job.depth}
+	if job.request != nil {
+		pending.Method = job.request.method
+		pending.Body = string(job.request.body)
+		pending.ContentType = job.request.contentType
+		pending.Headers = job.request.headers
+		if chain := job.request.chain; chain != nil {
+			pending.StartRequest = chain.index + 1
+			pending.Value = chain.position
+		}
+	}
+	return pending
+}
 
-	err = chromedp.Run(
-		ictx,
-		chromedp.AttributeValue(`#recaptcha-anchor`, "aria-checked", &checked, &ok),
-	)
+// checkpoints saves the frontier every checkpoint interval until stop is
+// closed.
+func checkpoints(frontier *urlFrontier, stop <-chan struct{}) {
+	interval := time.Duration(settings.CheckpointInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultCheckpointInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			saveCheckpoint(frontier)
+		case <-stop:
+			return
+		}
+	}
+}
 
+// saveCheckpoint writes the frontier to the checkpoint file. It goes
+// through a temporary file so a crash while saving keeps the last one, and
+// no page is written to the output file until it is saved.
+func saveCheckpoint(frontier *urlFrontier) {
+	if settings.CheckpointFile == "" {
+		return
+	}
+	frontier.saving.Lock()
+	defer frontier.saving.Unlock()
+	data, err := json.Marshal(frontier.snapshot())
 	if err != nil {
 		logErrors(err)
-		os.Exit(0)
+		return
 	}
-
-	isCheched, _ := strconv.ParseBool(checked)
-
-	if !isCheched {
-		var audioSource *string
-		ictx2, _ := chromedp.NewContext(ctx, chromedp.WithTargetID(challengeNode.TargetID))
-
-		err = chromedp.Run(
-			ictx2,
-			chromedp.WaitVisible(`#recaptcha-audio-button`, chromedp.ByID),
-			chromedp.Click(`#recaptcha-audio-button`, chromedp.NodeVisible),
-			chromedp.WaitVisible(`#audio-response`, chromedp.ByID),
-			chromedp.AttributeValue(`#audio-source`, "src", audioSource, &ok),
-		)
-
-		if err != nil {
-			logErrors(err)
-			os.Exit(0)
-		}
-
-		if audioSource != nil {
-			text, err := parseCatchAudio(*audioSource)
-
-			if err != nil {
-				logErrors(err)
-				os.Exit(0)
-			}
-
-			err = chromedp.Run(
-				ictx2,
-				chromedp.WaitVisible(`#audio-response`, chromedp.ByID),
-				chromedp.SetValue(`#audio-response`, text, chromedp.ByID),
-				chromedp.Click(`#recaptcha-verify-button`, chromedp.NodeVisible),
-			)
-		}
+	err = writeFileAtomic(settings.CheckpointFile, data, 0644)
+	if err != nil {
+		logErrors(err)
 	}
+	changes.saveProgress()
+}
 
-	var body string
-	err = chromedp.Run(ctx,
-		chromedp.InnerHTML(`body`, &body, chromedp.NodeVisible, chromedp.ByQuery),
-	)
+func loadCheckpoint() (checkpointState, error) {
+	state := checkpointState{}
+	data, err := ioutil.ReadFile(settings.CheckpointFile)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
 
-	r := strings.NewReader(body)
-	doc, err := goquery.NewDocumentFromReader(r)
+// writeFileAtomic replaces a file with data, so readers and crashes only
+// ever see the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, perm)
 	if err != nil {
-		logErrors(err)
-		os.Exit(0)
+		return err
 	}
+	return os.Rename(tmp, path)
+}
 
-	return doc
+// unfinished reports whether pages are left queued or pending once the
+// frontier was stopped.
+func (f *urlFrontier) unfinished() bool {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.queue) != 0 || len(f.running) != 0
 }
 
-func getURL(urls []string) <-chan string {
-	c := make(chan string)
-	go func() {
-		re := regexp2.MustCompile(`(\[\d{1,10}-\d{1,10}\]$)`, 0)
-		for _, urlLink := range urls {
-			stringMatch, _ := re.FindStringMatch(urlLink)
-			if stringMatch != nil {
-				val2 := strings.Replace(urlLink, fmt.Sprintf("%s", stringMatch), "", -2)
-
-				urlRange := fmt.Sprintf("%s", stringMatch)
-				urlRange = strings.Replace(urlRange, "[", "", -2)
-				urlRange = strings.Replace(urlRange, "]", "", -2)
-
-				rang := strings.Split(urlRange, "-")
-				int1, _ := strconv.ParseInt(rang[0], 10, 64)
-				int2, _ := strconv.ParseInt(rang[1], 10, 64)
-				for x := int1; x <= int2; x++ {
-					c <- fmt.Sprintf("%s%d", val2, x)
-				}
-			} else {
-				c <- urlLink
-			}
-		}
-		close(c)
-	}()
-	return c
+// stop makes next return false at once, leaving the queue as it is for
+// the checkpoint.
+func (f *urlFrontier) stop() {
+	f.Lock()
+	defer f.Unlock()
+	f.stopped = true
+	f.cond.Broadcast()
 }
 
-func worker(jobs <-chan workerJob, results chan<- workerJob, wg *sync.WaitGroup) {
-	defer wg.Done()
-	userAgents := settings.UserAgents
-	if len(userAgents) == 0 {
-		userAgents = append(userAgents, "")
-	}
-	for count := 0; count < len(userAgents); count++ {
-		userAgent := userAgents[count]
-		for job := range jobs {
-			var doc *goquery.Document
-			if settings.JavaScript {
-				doc = navigateURL(job.startURL, userAgent)
-			} else {
-				doc = crawlURL(job.startURL, userAgent)
-			}
-			if doc == nil {
-				continue
-			}
-			fmt.Println("URL:", job.startURL)
-			linkOutput := make(map[string]interface{})
-			for _, selector := range job.siteMap.Selectors {
-				if job.parent == selector.ParentSelectors[0] {
-					if selector.Type == "SelectorText" {
-						resultText := selectorText(doc, &selector)
-						if len(resultText) != 0 {
-							if len(resultText) == 1 {
-								linkOutput[selector.ID] = resultText[0]
-							} else {
-								linkOutput[selector.ID] = resultText
-							}
-						}
-					} else if selector.Type == "SelectorLink" {
-						links := selectorLink(doc, &selector, job.startURL)
-						if hasElement(selector.ParentSelectors, selector.ID) {
-							for _, link := range links {
-								if !hasElement(job.siteMap.StartURL, link) {
-									job.siteMap.StartURL = append(job.siteMap.StartURL, link)
-								}
-							}
-						} else {
-							childSelector := getChildSelector(&selector)
-							if childSelector == true {
-								linkOutput[selector.ID] = links
-							} else {
-								newSiteMap := getSiteMap(links, &selector)
-								result := scraper(newSiteMap, selector.ID)
-								linkOutput[selector.ID] = result
-							}
-						}
-					} else if selector.Type == "SelectorElementAttribute" {
-						resultText := selectorElementAttribute(doc, &selector)
-						linkOutput[selector.ID] = resultText
-					} else if selector.Type == "SelectorImage" {
-						resultText := selectorImage(doc, &selector)
-						if len(resultText) != 0 {
-							if len(resultText) == 1 {
-								linkOutput[selector.ID] = resultText[0]
-							} else {
-								linkOutput[selector.ID] = resultText
-							}
-						}
-					} else if selector.Type == "SelectorElement" {
-						resultText := selectorElement(doc, &selector)
-						linkOutput[selector.ID] = resultText
-					} else if selector.Type == "SelectorTable" {
-						resultText := selectorTable(doc, &selector)
-						linkOutput[selector.ID] = resultText
-					}
-				}
-			}
-			job.linkOutput = linkOutput
-			results <- job
-		}
-	}
+// hold keeps the frontier open while it is being seeded.
+func (f *urlFrontier) hold() {
+	f.Lock()
+	defer f.Unlock()
+	f.active++
 }
 
-func scraper(siteMap *scraping, parent string) map[string]interface{} {
-	output := make(map[string]interface{})
-	var wg sync.WaitGroup
-	jobs := make(chan workerJob, settings.Workers)
-	results := make(chan workerJob, settings.Workers)
-	outputChannel := make(chan map[string]interface{})
-	for x := 1; x <= settings.Workers; x++ {
-		wg.Add(1)
-		go worker(jobs, results, &wg)
+// done marks a job, or a hold, as finished.
+func (f *urlFrontier) done() {
+	f.Lock()
+	defer f.Unlock()
+	f.active--
+	if f.active == 0 {
+		f.cond.Broadcast()
 	}
-	go func() {
-		fc := getURL(siteMap.StartURL)
-		if fc != nil {
-			for startURL := range fc {
-				if !validURL(startURL) {
-					continue
-				}
-				workerJob := workerJob{
-					parent:   parent,
-					startURL: startURL,
-					siteMap:  siteMap,
-				}
-				jobs <- workerJob
-			}
-			close(jobs)
-		}
-	}()
-	go func() {
-		pageOutput := make(map[string]interface{})
-		for job := range results {
-			if len(job.linkOutput) != 0 {
-				if job.parent == "_root" {
-					out, err := ioutil.ReadFile(settings.OutputFile)
-					if err != nil {
-						logErrors(err)
-						os.Exit(0)
-					}
-					var data = map[string]interface{}{}
-					err = json.Unmarshal(out, &data)
-					data[job.startURL] = job.linkOutput
-					switch settings.Export {
-					case "xml":
-						output, err := xml.MarshalIndent(data, "", " ")
-						if err != nil {
-							logErrors(err)
-							os.Exit(0)
-						}
-						_ = ioutil.WriteFile(settings.OutputFile, output, 0644)
-					case "csv":
-						csvFile, err := os.OpenFile(settings.OutputFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-						if err != nil {
-							logErrors(err)
-							os.Exit(0)
-						}
-						csvWriter := csv.NewWriter(csvFile)
-						var rows [][]string
-						for i, v := range data {
-							rows = append(rows, []string{i, fmt.Sprint(v)})
-						}
-						for _, row := range rows {
-							err = csvWriter.Write(row)
-							if err != nil {
-								frontendLog(err)
-								break
-							}
-						}
-						csvWriter.Flush()
-						err = csvFile.Close()
-
-						if err != nil {
-							frontendLog(err)
-						}
-					case "json":
-						output, err := json.MarshalIndent(data, "", " ")
-						if err != nil {
-							logErrors(err)
-							os.Exit(0)
-						}
-						_ = ioutil.WriteFile(settings.OutputFile, output, 0644)
-					default:
-						fmt.Println("Error: Please choose an output format.")
-					}
-				} else {
-					pageOutput[job.startURL] = job.linkOutput
-				}
-			}
-		}
-		outputChannel <- pageOutput
-	}()
-	wg.Wait()
-	close(results)
-	output = <-outputChannel
-	return output
 }
 
 func validURL(uri string) bool {
@@ -794,6 +4212,10 @@ func outputResult() {
 		"json": true,
 	}
 	if allowedFormat[userFormat] {
+		if resume {
+			// Keep the records written before the crawl was interrupted.
+			return
+		}
 		err := ioutil.WriteFile(settings.OutputFile, []byte{}, 0644)
 		if err != nil {
 			logErrors(err)
@@ -804,10 +4226,100 @@ func outputResult() {
 	}
 }
 
+// handleSignals stops the crawl gracefully on SIGINT or SIGTERM: nothing
+// new is dispatched and the pages in flight get the shutdown timeout to
+// finish before their requests and Chrome sessions are cancelled. A
+// second signal exits at once.
+func handleSignals(cancel context.CancelFunc) func() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+		timeout := time.Duration(settings.ShutdownTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		fmt.Println("Stopping, waiting up to", timeout, "for the pages in flight. Interrupt again to exit now.")
+		close(stopping)
+		timer := time.AfterFunc(timeout, cancel)
+		defer timer.Stop()
+		select {
+		case <-signals:
+			_, _ = fmt.Fprintln(os.Stderr, "Forced exit")
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// pause sleeps for d, or until the crawl is aborted.
+func pause(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-crawlCtx.Done():
+	}
+}
+
+func interrupted() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
 func scrape() {
 	readJSON()
 	clearCache()
+	rand.Seed(time.Now().UnixNano())
+	stopping = make(chan struct{})
+	var cancel context.CancelFunc
+	crawlCtx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stopSignals := handleSignals(cancel)
+	defer stopSignals()
+	report = &runReport{}
+	pages = newCrawledPages()
+	for _, path := range []string{settings.CookieFile, settings.CookieImport} {
+		if path == "" {
+			continue
+		}
+		err := loadCookies(path)
+		if err != nil && !os.IsNotExist(err) {
+			logErrors(err)
+		}
+	}
+	session = &loginSession{}
+	err := login()
+	if err != nil {
+		logErrors(err)
+		_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
 	siteMap := sitemap
+	fmt.Println("Start pages to request:", countRequests(&siteMap))
 	outputResult()
-	_ = scraper(&siteMap, "_root")
+	_, _ = scraper(&siteMap, "_root")
+	changes.save()
+	saveCookies()
+	proxies.summary()
+	report.summary()
+	if interrupted() {
+		fmt.Println("Crawl interrupted, run with --resume to continue.")
+	}
 }
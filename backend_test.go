@@ -0,0 +1,1071 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 120 * time.Second, 120 * time.Second},
+		{"0", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 59 * time.Minute, time.Hour},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), -2 * time.Hour, 0},
+	}
+	for _, test := range tests {
+		got := parseRetryAfter(test.value)
+		if got < test.min || got > test.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", test.value, got, test.min, test.max)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&httpError{statusCode: http.StatusTooManyRequests}, true},
+		{&httpError{statusCode: http.StatusServiceUnavailable}, true},
+		{fmt.Errorf("fetching: %w", &httpError{statusCode: http.StatusBadGateway}), true},
+		{&httpError{statusCode: http.StatusNotFound}, false},
+		{&httpError{statusCode: http.StatusForbidden}, false},
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{errors.New("invalid URL"), false},
+	}
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("retryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	settings = settingsT{RetryDelay: 100, RetryMaxDelay: 1000}
+	tests := []struct {
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{0, io.ErrUnexpectedEOF, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, io.ErrUnexpectedEOF, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, io.ErrUnexpectedEOF, 400 * time.Millisecond, 800 * time.Millisecond},
+		{10, io.ErrUnexpectedEOF, 500 * time.Millisecond, time.Second},
+		{0, &httpError{statusCode: http.StatusTooManyRequests, retryAfter: 5 * time.Second}, 5 * time.Second, 5 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			got := retryDelay(test.attempt, test.err)
+			if got < test.min || got > test.max {
+				t.Errorf("retryDelay(%d, %v) = %s, want between %s and %s", test.attempt, test.err, got, test.min, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestProxyFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&httpError{statusCode: http.StatusProxyAuthRequired}, true},
+		{&httpError{statusCode: http.StatusServiceUnavailable}, false},
+		{&net.OpError{Op: "proxyconnect", Err: syscall.ECONNREFUSED}, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false},
+		{&net.DNSError{Err: "no such host", Name: "example.com"}, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("socks connect tcp: username/password authentication failed"), true},
+		{errors.New("page load error net::ERR_PROXY_CONNECTION_FAILED"), true},
+		{errors.New("page load error net::ERR_NAME_NOT_RESOLVED"), false},
+	}
+	for _, test := range tests {
+		if got := proxyFailure(test.err); got != test.want {
+			t.Errorf("proxyFailure(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestProxyPool(t *testing.T) {
+	settings = settingsT{ProxyMaxFailures: 2, ProxyRetest: 3600}
+	pool := newProxyPool([]string{"one:8080", "", "http://two:8080", "socks5://three:1080"})
+	if len(pool.proxies) != 3 {
+		t.Fatalf("got %d proxies, want 3", len(pool.proxies))
+	}
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		hosts = append(hosts, pool.get("example.com").url.Host)
+	}
+	if want := []string{"one:8080", "two:8080", "three:1080", "one:8080"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("round-robin gave %v, want %v", hosts, want)
+	}
+
+	two := pool.proxies[1]
+	failure := &httpError{statusCode: http.StatusProxyAuthRequired}
+	pool.report(two, failure)
+	pool.report(two, &httpError{statusCode: http.StatusNotFound})
+	pool.report(two, failure)
+	if two.dead {
+		t.Error("an error of the target site counted against the proxy")
+	}
+	pool.report(two, failure)
+	if !two.dead {
+		t.Fatal("proxy not marked dead after 2 proxy failures")
+	}
+	for i := 0; i < 6; i++ {
+		if proxy := pool.get("example.com"); proxy == two {
+			t.Fatal("get returned a dead proxy")
+		}
+	}
+	if two.attempts != 4 || two.successes != 1 {
+		t.Errorf("attempts/successes = %d/%d, want 4/1", two.attempts, two.successes)
+	}
+
+	for _, proxy := range pool.proxies {
+		proxy.dead = true
+		proxy.deadUntil = time.Now().Add(time.Hour)
+	}
+	pool.proxies[2].deadUntil = time.Now().Add(time.Minute)
+	if proxy := pool.get("example.com"); proxy != pool.proxies[2] {
+		t.Errorf("with every proxy dead got %v, want the one re-tested first", proxy.url)
+	}
+}
+
+func TestProxyPoolSticky(t *testing.T) {
+	settings = settingsT{ProxyRotation: "sticky"}
+	pool := newProxyPool([]string{"one:8080", "two:8080"})
+	first := pool.get("a.example.com")
+	other := pool.get("b.example.com")
+	if first == other {
+		t.Error("two hosts share the first proxy")
+	}
+	for i := 0; i < 3; i++ {
+		if proxy := pool.get("a.example.com"); proxy != first {
+			t.Errorf("sticky host moved from %s to %s", first.url.Host, proxy.url.Host)
+		}
+	}
+	first.dead = true
+	if proxy := pool.get("a.example.com"); proxy == first {
+		t.Error("sticky host kept its dead proxy")
+	}
+}
+
+func TestRateLimiterRate(t *testing.T) {
+	limiter := &rateLimiter{rate: 20, burst: 2, hosts: make(map[string]*hostLimit)}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		limiter.acquire("example.com")()
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("the burst waited %s", elapsed)
+	}
+	limiter.acquire("other.example.com")()
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("another host waited %s", elapsed)
+	}
+	for i := 0; i < 2; i++ {
+		limiter.acquire("example.com")()
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Errorf("2 requests past the burst at 20/s took %s, want about 100ms", elapsed)
+	}
+}
+
+func TestRateLimiterConcurrency(t *testing.T) {
+	limiter := &rateLimiter{burst: 1, concurrency: 1, hosts: make(map[string]*hostLimit)}
+	release := limiter.acquire("example.com")
+	acquired := make(chan func())
+	go func() {
+		acquired <- limiter.acquire("example.com")
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a second request got the host's only slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case second := <-acquired:
+		second()
+	case <-time.After(time.Second):
+		t.Fatal("the slot was not handed over once released")
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	defer func(ctx context.Context) {
+		crawlCtx = ctx
+	}(crawlCtx)
+	ctx, cancel := context.WithCancel(context.Background())
+	crawlCtx = ctx
+	limiter := &rateLimiter{rate: 0.1, burst: 1, concurrency: 1, hosts: make(map[string]*hostLimit)}
+	release := limiter.acquire("example.com")
+	defer release()
+	done := make(chan struct{})
+	go func() {
+		limiter.acquire("example.com")()
+		limiter.acquire("other.example.com")()
+		limiter.acquire("other.example.com")()
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("acquire kept waiting after the crawl was aborted")
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	body := []byte(`# example
+User-agent: googlebot
+Disallow: /
+
+User-agent: other
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow: /search?
+Crawl-delay: 2.5
+
+Sitemap: https://example.com/sitemap.xml
+`)
+	rules := &robotsRules{}
+	parseRobots(rules, body)
+	if rules.crawlDelay != 2500*time.Millisecond {
+		t.Errorf("crawlDelay = %s, want 2.5s", rules.crawlDelay)
+	}
+	if want := []string{"https://example.com/sitemap.xml"}; !reflect.DeepEqual(rules.sitemaps, want) {
+		t.Errorf("sitemaps = %v, want %v", rules.sitemaps, want)
+	}
+
+	settings = settingsT{}
+	robots = &robotsCache{hosts: map[string]*robotsRules{"https://example.com/robots.txt": rules}}
+	rules.once.Do(func() {})
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/", true},
+		{"https://example.com/about", true},
+		{"https://example.com/private", false},
+		{"https://example.com/private/page", false},
+		{"https://example.com/private/public/page", true},
+		{"https://example.com/files/report.pdf", false},
+		{"https://example.com/files/report.pdf?x=1", true},
+		{"https://example.com/search", true},
+		{"https://example.com/search?q=go", false},
+	}
+	for _, test := range tests {
+		if got := robotsAllowed(test.url); got != test.want {
+			t.Errorf("robotsAllowed(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestCrawlDelay(t *testing.T) {
+	limiter := &rateLimiter{rate: 10, burst: 5, hosts: make(map[string]*hostLimit)}
+	limiter.crawlDelay("example.com", 2*time.Second)
+	h := limiter.hosts["example.com"]
+	if h.burst != 1 || h.tokens > 1 {
+		t.Errorf("burst/tokens = %d/%v, want 1 and at most 1", h.burst, h.tokens)
+	}
+	if h.rate != 0.5 {
+		t.Errorf("rate = %v, want 0.5", h.rate)
+	}
+	limiter.crawlDelay("fast.example.com", 10*time.Millisecond)
+	if h := limiter.hosts["fast.example.com"]; h.rate != 10 || h.burst != 1 {
+		t.Errorf("a crawl delay looser than the rate gave rate %v burst %d, want 10 and 1", h.rate, h.burst)
+	}
+}
+
+func TestDefaultSettingsMatchSitemap(t *testing.T) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shipped jsonType
+	err = json.Unmarshal(data, &shipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := reflect.ValueOf(defaultSettings())
+	values := reflect.ValueOf(shipped.Settings)
+	for i := 0; i < defaults.NumField(); i++ {
+		field := defaults.Type().Field(i)
+		if defaults.Field(i).IsZero() {
+			continue
+		}
+		if got, want := values.Field(i).Interface(), defaults.Field(i).Interface(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: sitemap.json ships %v, default is %v", field.Tag.Get("json"), got, want)
+		}
+	}
+
+	var missing jsonType
+	missing.Settings = defaultSettings()
+	err = json.Unmarshal([]byte(`{"settings": {"workers": 4}}`), &missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !missing.Settings.HTTP2 || missing.Settings.Workers != 4 || missing.Settings.ReadTimeout != 30 {
+		t.Errorf("a config without the keys got %+v", missing.Settings)
+	}
+}
+
+func TestLoadCookies(t *testing.T) {
+	expires := time.Now().Add(24 * time.Hour).Unix()
+	data := "# Netscape HTTP Cookie File\n" +
+		"\n" +
+		".example.com\tTRUE\t/\tFALSE\t" + strconv.FormatInt(expires, 10) + "\tsid\tabc\n" +
+		"#HttpOnly_shop.example.com\tFALSE\t/cart\tTRUE\t0\ttoken\txyz\n" +
+		".example.com\tTRUE\t/\tFALSE\t1\told\texpired\n" +
+		"example.com\tTRUE\t/\tFALSE\n"
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies = newCookieStore()
+	err = loadCookies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := cookies.all()
+	sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+	if len(got) != 2 {
+		t.Fatalf("loaded %d cookies, want 2: %+v", len(got), got)
+	}
+	tests := []struct {
+		cookie storedCookie
+		name   string
+		domain string
+		path   string
+		secure bool
+		http   bool
+	}{
+		{got[0], "sid", "example.com", "/", false, false},
+		{got[1], "token", "shop.example.com", "/cart", true, true},
+	}
+	for _, test := range tests {
+		c := test.cookie
+		if c.Name != test.name || c.Domain != test.domain || c.Path != test.path || c.Secure != test.secure || c.HTTPOnly != test.http {
+			t.Errorf("cookie = %+v, want %s on %s%s secure=%v httpOnly=%v", c, test.name, test.domain, test.path, test.secure, test.http)
+		}
+	}
+}
+
+func TestSetCookiesRejected(t *testing.T) {
+	cookies = newCookieStore()
+	page, _ := url.Parse("https://evil.example.net/account/settings")
+	cookies.SetCookies(page, []*http.Cookie{
+		{Name: "stolen", Value: "1", Domain: "bank.com"},
+		{Name: "tld", Value: "1", Domain: "net"},
+		{Name: "suffix", Value: "1", Domain: "example.net"},
+		{Name: "own", Value: "1", Domain: "evil.example.net"},
+		{Name: "local", Value: "1"},
+	})
+	got := map[string]string{}
+	for _, stored := range cookies.all() {
+		got[stored.Name] = stored.Domain + stored.Path
+	}
+	want := map[string]string{
+		"suffix": "example.net/account",
+		"own":    "evil.example.net/account",
+		"local":  "evil.example.net/account",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+}
+
+func TestIterateValues(t *testing.T) {
+	tests := []struct {
+		iterate iterateParam
+		want    []string
+		err     bool
+	}{
+		{iterateParam{Values: []string{"a", "b"}}, []string{"a", "b"}, false},
+		{iterateParam{Range: "1-3"}, []string{"1", "2", "3"}, false},
+		{iterateParam{Range: "1 - 3"}, []string{"1", "2", "3"}, false},
+		{iterateParam{Range: "0-20:10"}, []string{"0", "10", "20"}, false},
+		{iterateParam{Range: "008-010"}, []string{"008", "009", "010"}, false},
+		{iterateParam{Range: "5-1"}, nil, true},
+		{iterateParam{Range: "1-3]x["}, nil, true},
+		{iterateParam{Range: "a-b"}, nil, true},
+	}
+	for _, test := range tests {
+		got, err := iterateValues(&test.iterate)
+		if (err != nil) != test.err || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("iterateValues(%+v) = %v, %v, want %v", test.iterate, got, err, test.want)
+		}
+	}
+}
+
+func TestNewStartJob(t *testing.T) {
+	siteMap := &scraping{}
+	tests := []struct {
+		start       startRequest
+		form        url.Values
+		value       string
+		url         string
+		method      string
+		body        string
+		contentType string
+	}{
+		{
+			start:       startRequest{URL: "https://example.com/search", Form: map[string]string{"q": "go"}},
+			url:         "https://example.com/search",
+			method:      http.MethodPost,
+			body:        "q=go",
+			contentType: "application/x-www-form-urlencoded",
+		},
+		{
+			start: startRequest{URL: "https://example.com/list.aspx", Form: map[string]string{"__EVENTTARGET": "Pager${value}"},
+				Iterate: &iterateParam{Param: "__EVENTTARGET"}},
+			form:        url.Values{"__VIEWSTATE": {"abc"}},
+			value:       "2",
+			url:         "https://example.com/list.aspx",
+			method:      http.MethodPost,
+			body:        "__EVENTTARGET=Pager%242&__VIEWSTATE=abc",
+			contentType: "application/x-www-form-urlencoded",
+		},
+		{
+			start: startRequest{URL: "https://example.com/search?lang=en", Method: "get", Form: map[string]string{"q": "go"},
+				Iterate: &iterateParam{Param: "page"}},
+			value:  "3",
+			url:    "https://example.com/search?lang=en&page=3&q=go",
+			method: http.MethodGet,
+		},
+		{
+			start: startRequest{URL: "https://example.com/api", JSON: map[string]interface{}{"page": "{value}", "size": 10},
+				Iterate: &iterateParam{Param: "page"}},
+			value:       "4",
+			url:         "https://example.com/api",
+			method:      http.MethodPost,
+			body:        `{"page":"4","size":10}`,
+			contentType: "application/json",
+		},
+	}
+	for _, test := range tests {
+		job, err := newStartJob(test.start, test.form, test.value, "_root", siteMap)
+		if err != nil {
+			t.Errorf("newStartJob(%+v): %v", test.start, err)
+			continue
+		}
+		if job.startURL != test.url || job.request.method != test.method || string(job.request.body) != test.body || job.request.contentType != test.contentType {
+			t.Errorf("newStartJob(%+v) = %s %s %q %s, want %s %s %q %s", test.start, job.request.method, job.startURL, job.request.body, job.request.contentType,
+				test.method, test.url, test.body, test.contentType)
+		}
+	}
+	_, err := newStartJob(startRequest{URL: "https://example.com/api", Method: "GET", JSON: map[string]interface{}{}}, nil, "", "_root", siteMap)
+	if err == nil {
+		t.Error("a GET start request with a JSON body was accepted")
+	}
+}
+
+func TestNextPostback(t *testing.T) {
+	start := startRequest{URL: "https://example.com/list.aspx", Form: map[string]string{"page": "{value}"},
+		Iterate: &iterateParam{Param: "page", Range: "1-3"}}
+	job, err := newStartJob(start, url.Values{"__VIEWSTATE": {"first"}}, "1", "_root", &scraping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.request.chain = &postback{start: start, values: []string{"1", "2", "3"}}
+	var bodies []string
+	for _, state := range []string{"second", "third", "fourth"} {
+		doc, _ := goquery.NewDocumentFromReader(strings.NewReader(`<form><input type="hidden" name="__VIEWSTATE" value="` + state + `"></form>`))
+		next, ok := nextPostback(job, doc)
+		if !ok {
+			break
+		}
+		bodies = append(bodies, string(next.request.body))
+		job = next
+	}
+	want := []string{"__VIEWSTATE=second&page=2", "__VIEWSTATE=third&page=3"}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("postbacks = %v, want %v", bodies, want)
+	}
+}
+
+func TestExpandURL(t *testing.T) {
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{"https://example.com/", []string{"https://example.com/"}},
+		{"https://example.com/page/[1-3]", []string{"https://example.com/page/1", "https://example.com/page/2", "https://example.com/page/3"}},
+		{"https://example.com/?p=[0-20:10]", []string{"https://example.com/?p=0", "https://example.com/?p=10", "https://example.com/?p=20"}},
+		{"https://example.com/[08-10].html", []string{"https://example.com/08.html", "https://example.com/09.html", "https://example.com/10.html"}},
+		{"https://example.com/{red,blue}/[1-2]", []string{"https://example.com/red/1", "https://example.com/red/2", "https://example.com/blue/1", "https://example.com/blue/2"}},
+		{"https://example.com/café/[1-2]", []string{"https://example.com/café/1", "https://example.com/café/2"}},
+		{"https://example.com/ü/{a,b}/é", []string{"https://example.com/ü/a/é", "https://example.com/ü/b/é"}},
+	}
+	for _, test := range tests {
+		var got []string
+		expandURL(test.template, func(pageURL string) {
+			got = append(got, pageURL)
+		})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expandURL(%q) = %v, want %v", test.template, got, test.want)
+		}
+		if count := countURLs([]string{test.template}); count != len(test.want) {
+			t.Errorf("countURLs(%q) = %d, want %d", test.template, count, len(test.want))
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"HTTP://Example.COM/Path", "http://example.com/Path"},
+		{"http://example.com:80/", "http://example.com/"},
+		{"https://example.com:443/", "https://example.com/"},
+		{"https://example.com:8443/", "https://example.com:8443/"},
+		{"https://example.com/page#top", "https://example.com/page"},
+		{"https://example.com/?b=2&a=1", "https://example.com/?a=1&b=2"},
+		{"https://example.com/?q=a+b&page&utm_source=x&fbclid=y", "https://example.com/?page=&q=a+b"},
+	}
+	for _, test := range tests {
+		if got := normalizeURL(test.url); got != test.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestFrontierKeepsOriginalURL(t *testing.T) {
+	pages = newCrawledPages()
+	frontier := newFrontier()
+	original := "https://Example.com/?q=a+b&page&utm_source=x"
+	siteMap := &scraping{}
+	if !frontier.add(workerJob{parent: "_root", startURL: original, siteMap: siteMap}) {
+		t.Fatal("first add was not queued")
+	}
+	if frontier.add(workerJob{parent: "_root", startURL: "https://example.com/?page=&q=a+b#top", siteMap: siteMap}) {
+		t.Error("an equivalent URL was queued again")
+	}
+	job, ok := frontier.next()
+	if !ok || job.startURL != original {
+		t.Errorf("next() = %q, want %q", job.startURL, original)
+	}
+}
+
+func TestCrawledPagesWait(t *testing.T) {
+	pages = newCrawledPages()
+	first := workerJob{parent: "detail", startURL: "https://example.com/x", siteMap: &scraping{ancestors: []string{"_root https://example.com/1"}}}
+	second := workerJob{parent: "detail", startURL: "https://example.com/x", siteMap: &scraping{ancestors: []string{"_root https://example.com/2"}}}
+	if _, scraped, claimed := pages.claim(first); scraped || !claimed {
+		t.Fatal("an unseen page was not claimed")
+	}
+	got := make(chan map[string]interface{})
+	go func() {
+		output, scraped, _ := pages.claim(second)
+		if !scraped {
+			output = nil
+		}
+		got <- output
+	}()
+	select {
+	case <-got:
+		t.Fatal("the second record did not wait for the page being scraped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.linkOutput = map[string]interface{}{"title": "x"}
+	pages.finish(first)
+	select {
+	case output := <-got:
+		if !reflect.DeepEqual(output, first.linkOutput) {
+			t.Errorf("the second record got %v, want %v", output, first.linkOutput)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the second record was not woken up")
+	}
+}
+
+func TestCrawledPagesDeadlock(t *testing.T) {
+	pages = newCrawledPages()
+	x := workerJob{parent: "detail", startURL: "https://example.com/x", siteMap: &scraping{ancestors: []string{"_root https://example.com/1"}}}
+	y := workerJob{parent: "detail", startURL: "https://example.com/y", siteMap: &scraping{ancestors: []string{"_root https://example.com/2"}}}
+	pages.claim(x)
+	pages.claim(y)
+	// x links to y and waits for it
+	yFromX := workerJob{parent: "detail", startURL: y.startURL, siteMap: &scraping{ancestors: x.linkPath().pages}}
+	go pages.claim(yFromX)
+	time.Sleep(20 * time.Millisecond)
+	// y links to x, waiting for it would never end
+	xFromY := workerJob{parent: "detail", startURL: x.startURL, siteMap: &scraping{ancestors: y.linkPath().pages}}
+	done := make(chan bool)
+	go func() {
+		_, scraped, claimed := pages.claim(xFromY)
+		done <- scraped || claimed
+	}()
+	select {
+	case claimed := <-done:
+		if claimed {
+			t.Error("a deadlocked page was reported scraped or claimed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("claim deadlocked")
+	}
+}
+
+func TestCrawledPagesCache(t *testing.T) {
+	pages = newCrawledPages()
+	siteMap := &scraping{}
+	for i := 0; i < pageCacheSize+10; i++ {
+		job := workerJob{parent: "detail", startURL: fmt.Sprintf("https://example.com/%d", i), siteMap: siteMap}
+		pages.claim(job)
+		job.linkOutput = map[string]interface{}{"n": i}
+		pages.finish(job)
+	}
+	if len(pages.outputs) != pageCacheSize || len(pages.order) != pageCacheSize {
+		t.Errorf("kept %d outputs, want %d", len(pages.outputs), pageCacheSize)
+	}
+	if _, scraped, _ := pages.claim(workerJob{parent: "detail", startURL: "https://example.com/0", siteMap: siteMap}); scraped {
+		t.Error("the oldest output was not dropped")
+	}
+	if _, scraped, _ := pages.claim(workerJob{parent: "detail", startURL: fmt.Sprintf("https://example.com/%d", pageCacheSize+9), siteMap: siteMap}); !scraped {
+		t.Error("the newest output was dropped")
+	}
+}
+
+// startCrawl writes config to sitemap.json in a temporary directory and
+// sets up the run like scrape does.
+func startCrawl(t *testing.T, config string) {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(dir)
+	})
+	err = ioutil.WriteFile(configFile, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readJSON()
+	stopping = make(chan struct{})
+	crawlCtx = context.Background()
+	report = &runReport{}
+	pages = newCrawledPages()
+	session = &loginSession{}
+	outputResult()
+}
+
+// readOutput returns the records of the output file.
+func readOutput(t *testing.T) map[string]interface{} {
+	t.Helper()
+	data, err := ioutil.ReadFile(settings.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := map[string]interface{}{}
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &output)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return output
+}
+
+func TestNestedScrapersShareDetailPages(t *testing.T) {
+	var mutex sync.Mutex
+	hits := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		hits[r.URL.Path]++
+		mutex.Unlock()
+		switch r.URL.Path {
+		case "/1", "/2":
+			fmt.Fprint(w, `<a class="detail" href="/x">x</a>`)
+		case "/x":
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, `<h1>x</h1>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	startCrawl(t, `{"settings": {"workers": 2, "export": "json", "output_filename": "output.json", "ignore_robots": true, "checkpoint_file": "", "cookie_file": ""},
+"sitemap": {"_id": "test", "startUrl": ["`+server.URL+`/1", "`+server.URL+`/2"], "selectors": [
+{"id": "detail", "type": "SelectorLink", "parentSelectors": ["_root"], "selector": "a.detail", "multiple": true},
+{"id": "title", "type": "SelectorText", "parentSelectors": ["detail"], "selector": "h1", "multiple": false}]}}`)
+	scraper(&sitemap, "_root")
+
+	output := readOutput(t)
+	want := map[string]interface{}{"detail": map[string]interface{}{server.URL + "/x": map[string]interface{}{"title": "x"}}}
+	for _, root := range []string{"/1", "/2"} {
+		if !reflect.DeepEqual(output[server.URL+root], want) {
+			t.Errorf("record of %s = %v, want %v", root, output[server.URL+root], want)
+		}
+	}
+	if hits["/x"] != 1 {
+		t.Errorf("the shared detail page was fetched %d times, want 1", hits["/x"])
+	}
+}
+
+func TestNestedScrapersLinkCycles(t *testing.T) {
+	var mutex sync.Mutex
+	hits := map[string]int{}
+	// The records of /1 and /2 each need the detail page the other one is
+	// scraping, and /x and /y link back to /1.
+	links := map[string]string{
+		"/1": `<a class="a" href="/x">x</a>`,
+		"/2": `<a class="a" href="/y">y</a>`,
+		"/x": `<h1>x</h1><a class="b" href="/z">z</a>`,
+		"/y": `<h1>y</h1><a class="b" href="/w">w</a>`,
+		"/z": `<h1>z</h1><a class="a" href="/y">y</a><a class="a" href="/x">x</a>`,
+		"/w": `<h1>w</h1><a class="a" href="/x">x</a>`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		hits[r.URL.Path]++
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		body, ok := links[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+	startCrawl(t, `{"settings": {"workers": 2, "export": "json", "output_filename": "output.json", "ignore_robots": true, "checkpoint_file": "", "cookie_file": ""},
+"sitemap": {"_id": "test", "startUrl": ["`+server.URL+`/1", "`+server.URL+`/2"], "selectors": [
+{"id": "a", "type": "SelectorLink", "parentSelectors": ["_root", "b"], "selector": "a.a", "multiple": true},
+{"id": "b", "type": "SelectorLink", "parentSelectors": ["a"], "selector": "a.b", "multiple": true},
+{"id": "title", "type": "SelectorText", "parentSelectors": ["a", "b"], "selector": "h1", "multiple": false}]}}`)
+	done := make(chan struct{})
+	go func() {
+		scraper(&sitemap, "_root")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the crawl did not end")
+	}
+
+	output := readOutput(t)
+	for root, pages := range map[string][]string{"/1": {"x", "z", "y", "w"}, "/2": {"y", "w", "x", "z"}} {
+		record, _ := json.Marshal(output[server.URL+root])
+		for _, page := range pages {
+			if !strings.Contains(string(record), `"title":"`+page+`"`) {
+				t.Errorf("record of %s = %s, missing page %s", root, record, page)
+			}
+		}
+	}
+	for page, count := range hits {
+		if count > 2 {
+			t.Errorf("%s was fetched %d times", page, count)
+		}
+	}
+}
+
+func TestURLPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		url     string
+		match   bool
+	}{
+		{"https://example.com/products/*", "https://example.com/products/1", true},
+		{"https://example.com/products/*", "https://example.com/about", false},
+		{"https://example.com/products/*", "https://shop.example.com/products/1", false},
+		{"https://example.com/page?", "https://example.com/page2", true},
+		{"https://example.com/page?", "https://example.com/page23", false},
+		{"*.pdf", "https://example.com/a.pdf", true},
+		{"*.pdf", "https://example.com/apdf", false},
+		{`/page=\d+/`, "https://example.com/list?page=3&sort=asc", true},
+		{`/page=\d+/`, "https://example.com/list?page=last", false},
+		{"/", "/", true},
+	}
+	for _, test := range tests {
+		re, err := urlPattern(test.pattern)
+		if err != nil {
+			t.Errorf("urlPattern(%q): %v", test.pattern, err)
+			continue
+		}
+		match, _ := re.MatchString(test.url)
+		if match != test.match {
+			t.Errorf("urlPattern(%q) matches %q = %v, want %v", test.pattern, test.url, match, test.match)
+		}
+	}
+	if _, err := urlPattern("/(/"); err == nil {
+		t.Error("an invalid regular expression compiled")
+	}
+}
+
+func TestCrawlScopeFilter(t *testing.T) {
+	scope := newCrawlScope(&scraping{
+		MaxDepth:       2,
+		AllowedDomains: []string{"*.Example.com", "example.org"},
+		IncludeURLs:    []string{"*/products/*", "/[?&]page=/"},
+		ExcludeURLs:    []string{"*.pdf"},
+	})
+	tests := []struct {
+		url    string
+		depth  int
+		reason string
+	}{
+		{"https://example.com/products/1", 0, ""},
+		{"https://shop.example.com/products/1", 2, ""},
+		{"https://example.org/list?page=2", 1, ""},
+		{"https://example.com/products/1", 3, "depth"},
+		{"https://example.net/products/1", 0, "domain"},
+		{"https://badexample.com/products/1", 0, "domain"},
+		{"https://example.com/about", 0, "pattern"},
+		{"https://example.com/products/manual.pdf", 0, "pattern"},
+	}
+	for _, test := range tests {
+		reason := scope.filter(workerJob{startURL: test.url, depth: test.depth})
+		if reason != test.reason {
+			t.Errorf("filter(%s at depth %d) = %q, want %q", test.url, test.depth, reason, test.reason)
+		}
+	}
+	if reason := newCrawlScope(&scraping{}).filter(workerJob{startURL: "https://example.net/a.pdf", depth: 10}); reason != "" {
+		t.Errorf("an empty scope filtered a page out: %q", reason)
+	}
+}
+
+func TestWriteRecordAtomicWithCheckpoint(t *testing.T) {
+	startCrawl(t, `{"settings": {"export": "json", "output_filename": "output.json", "checkpoint_file": "checkpoint.json", "cookie_file": ""}}`)
+	frontier := newFrontier()
+	job := workerJob{parent: "_root", startURL: "https://example.com/1", siteMap: &scraping{}}
+	frontier.add(job)
+	job, _ = frontier.next()
+	job.linkOutput = map[string]interface{}{"title": "1"}
+
+	// A checkpoint being saved holds the record back.
+	frontier.saving.Lock()
+	written := make(chan struct{})
+	go func() {
+		writeRecord(frontier, job)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("a record was written while the checkpoint was saved")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(readOutput(t)) != 0 || len(frontier.snapshot().Pending) != 1 {
+		t.Fatal("the record was written before the checkpoint was saved")
+	}
+	frontier.saving.Unlock()
+	<-written
+
+	saveCheckpoint(frontier)
+	state, err := loadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Pending) != 0 || !reflect.DeepEqual(state.Completed, []string{"https://example.com/1"}) {
+		t.Errorf("checkpoint after the record = %+v, want it completed", state)
+	}
+	if _, ok := readOutput(t)["https://example.com/1"]; !ok {
+		t.Error("the record was not written")
+	}
+}
+
+func TestStoppedRecordsStayPending(t *testing.T) {
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1":
+			// Done after the stop, but nothing of it is missing.
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, `<h1>1</h1>`)
+		case "/2":
+			fmt.Fprint(w, `<h1>2</h1><a class="detail" href="/b">b</a><a class="detail" href="/c">c</a><a class="detail" href="/d">d</a>`)
+		case "/b":
+			once.Do(func() {
+				close(stopping)
+			})
+			fmt.Fprint(w, `<h1>b</h1>`)
+		default:
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprint(w, `<h1>`+r.URL.Path+`</h1>`)
+		}
+	}))
+	defer server.Close()
+	startCrawl(t, `{"settings": {"workers": 2, "export": "json", "output_filename": "output.json", "ignore_robots": true, "checkpoint_file": "checkpoint.json", "cookie_file": ""},
+"sitemap": {"_id": "test", "startUrl": ["`+server.URL+`/1", "`+server.URL+`/2"], "selectors": [
+{"id": "title", "type": "SelectorText", "parentSelectors": ["_root", "detail"], "selector": "h1", "multiple": false},
+{"id": "detail", "type": "SelectorLink", "parentSelectors": ["_root"], "selector": "a.detail", "multiple": true}]}}`)
+	_, stopped := scraper(&sitemap, "_root")
+	if !stopped {
+		t.Error("the crawl was not reported stopped")
+	}
+
+	output := readOutput(t)
+	if !reflect.DeepEqual(output[server.URL+"/1"], map[string]interface{}{"title": "1", "detail": map[string]interface{}{}}) {
+		t.Errorf("record of /1 = %v, want it complete", output[server.URL+"/1"])
+	}
+	if record, ok := output[server.URL+"/2"]; ok {
+		t.Errorf("the partial record of /2 was written: %v", record)
+	}
+	state, err := loadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Pending) != 1 || state.Pending[0].URL != server.URL+"/2" {
+		t.Errorf("pending pages = %+v, want /2", state.Pending)
+	}
+}
+
+func TestChangeStoreRecord(t *testing.T) {
+	settings = settingsT{Incremental: true}
+	changes = newChangeStore()
+	hash := func(output map[string]interface{}) string {
+		data, _ := json.Marshal(output)
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	changes.previous = map[string]pageState{
+		"https://example.com/same":    {Hash: hash(map[string]interface{}{"title": "same"})},
+		"https://example.com/changed": {Hash: hash(map[string]interface{}{"title": "old"})},
+		"https://example.com/failed":  {ETag: `"1"`, Hash: hash(map[string]interface{}{"title": "failed"})},
+		"https://example.com/gone":    {Hash: hash(map[string]interface{}{"title": "gone"})},
+	}
+	tests := []struct {
+		url    string
+		output map[string]interface{}
+		write  bool
+		change interface{}
+	}{
+		{"https://example.com/same", map[string]interface{}{"title": "same"}, false, nil},
+		{"https://example.com/changed", map[string]interface{}{"title": "new"}, true, "changed"},
+		{"https://example.com/new", map[string]interface{}{"title": "new"}, true, "new"},
+		{"https://example.com/empty", map[string]interface{}{}, false, nil},
+		{"https://example.com/failed", map[string]interface{}{"_error": "timeout"}, true, nil},
+	}
+	for _, test := range tests {
+		write := changes.record(workerJob{parent: "_root", startURL: test.url, linkOutput: test.output})
+		if write != test.write || test.output["_change"] != test.change {
+			t.Errorf("record(%s) = %v with _change %v, want %v with %v", test.url, write, test.output["_change"], test.write, test.change)
+		}
+	}
+	if !reflect.DeepEqual(changes.current["https://example.com/failed"], changes.previous["https://example.com/failed"]) {
+		t.Error("a page that failed lost its previous state")
+	}
+	if removed := changes.removed(); !reflect.DeepEqual(removed, []string{"https://example.com/gone"}) {
+		t.Errorf("removed() = %v, want the page not found again", removed)
+	}
+}
+
+func TestIncrementalRevalidatesLinkedPages(t *testing.T) {
+	var mutex sync.Mutex
+	downloads := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		mutex.Lock()
+		downloads[r.URL.Path]++
+		mutex.Unlock()
+		w.Header().Set("ETag", `"1"`)
+		switch r.URL.Path {
+		case "/1":
+			fmt.Fprint(w, `<h1>1</h1><a class="detail" href="/x">x</a>`)
+		default:
+			fmt.Fprint(w, `<h1>`+r.URL.Path+`</h1>`)
+		}
+	}))
+	defer server.Close()
+	config := `{"settings": {"workers": 2, "export": "json", "output_filename": "output.json", "ignore_robots": true, "checkpoint_file": "", "cookie_file": "", "incremental": true, "incremental_file": "changes.json"},
+"sitemap": {"_id": "test", "startUrl": ["` + server.URL + `/1"], "selectors": [
+{"id": "title", "type": "SelectorText", "parentSelectors": ["_root", "detail"], "selector": "h1", "multiple": false},
+{"id": "detail", "type": "SelectorLink", "parentSelectors": ["_root"], "selector": "a.detail", "multiple": true}]}}`
+	startCrawl(t, config)
+	scraper(&sitemap, "_root")
+	changes.save()
+	if record, _ := readOutput(t)[server.URL+"/1"].(map[string]interface{}); record["_change"] != "new" {
+		t.Fatalf("first run record = %v, want a new one", record)
+	}
+	state, err := ioutil.ReadFile("changes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startCrawl(t, config)
+	err = ioutil.WriteFile("changes.json", state, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = newChangeStore()
+	scraper(&sitemap, "_root")
+	if output := readOutput(t); len(output) != 0 {
+		t.Errorf("second run wrote %v, want nothing", output)
+	}
+	if downloads["/1"] != 1 || downloads["/x"] != 1 {
+		t.Errorf("pages downloaded %v, want each once", downloads)
+	}
+}
+
+func TestCheckpointSavesChangeProgress(t *testing.T) {
+	startCrawl(t, `{"settings": {"export": "json", "output_filename": "output.json", "checkpoint_file": "checkpoint.json", "cookie_file": "", "incremental": true, "incremental_file": "changes.json"}}`)
+	changes.previous["https://example.com/old"] = pageState{Hash: "1"}
+	frontier := newFrontier()
+	job := workerJob{parent: "_root", startURL: "https://example.com/new", siteMap: &scraping{}}
+	frontier.add(job)
+	job, _ = frontier.next()
+	job.linkOutput = map[string]interface{}{"title": "new"}
+	writeRecord(frontier, job)
+	saveCheckpoint(frontier)
+
+	data, err := ioutil.ReadFile("changes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := changeState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Pages["https://example.com/old"]; !ok || len(state.Pages) != 1 {
+		t.Errorf("saved pages = %v, want the previous run's", state.Pages)
+	}
+	if _, ok := state.Current["https://example.com/new"]; !ok {
+		t.Errorf("saved progress = %v, want the page written", state.Current)
+	}
+}
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"crypto/tls"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -142,6 +140,7 @@ func saveSettings(ui lorca.UI) {
 	settings.Gui = fmt.Sprint(ui.Eval(`document.getElementById("settings_gui").checked.toString();`)) == "true"
 	settings.Log = fmt.Sprint(ui.Eval(`document.getElementById("settings_log").checked.toString();`)) == "true"
 	settings.JavaScript = fmt.Sprint(ui.Eval(`document.getElementById("settings_js").checked.toString();`)) == "true"
+	settings.IgnoreRobots = fmt.Sprint(ui.Eval(`document.getElementById("settings_robots").checked.toString();`)) != "true"
 	settings.Workers, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_workers").value;`)))
 	if err != nil {
 		frontendLog(err)
@@ -153,13 +152,91 @@ func saveSettings(ui lorca.UI) {
 		code := fmt.Sprintf(`document.getElementById("txt_useragent%d").value;`, i+1)
 		settings.UserAgents = append(settings.UserAgents, fmt.Sprint(ui.Eval(code)))
 	}
+	settings.RateLimit, err = strconv.ParseFloat(fmt.Sprint(ui.Eval(`document.getElementById("settings_rate_limit").value;`)), 64)
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.RateBurst, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_rate_burst").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.HostConcurrency, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_host_concurrency").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	limiter = newRateLimiter(&sitemap)
+	settings.ConnectTimeout, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_connect_timeout").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.ReadTimeout, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_read_timeout").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.RequestTimeout, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_request_timeout").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.MaxIdleConnsPerHost, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_max_idle_conns").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.HTTP2 = fmt.Sprint(ui.Eval(`document.getElementById("settings_http2").checked.toString();`)) == "true"
+	settings.MaxRedirects, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_max_redirects").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.MaxBodySize, err = strconv.ParseInt(fmt.Sprint(ui.Eval(`document.getElementById("settings_max_body_size").value;`)), 10, 64)
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.CookieFile = fmt.Sprint(ui.Eval(`document.getElementById("settings_cookie_file").value;`))
+	settings.CookieImport = fmt.Sprint(ui.Eval(`document.getElementById("settings_cookie_import").value;`))
+	settings.CheckpointFile = fmt.Sprint(ui.Eval(`document.getElementById("settings_checkpoint_file").value;`))
+	settings.CheckpointInterval, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_checkpoint_interval").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.ShutdownTimeout, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_shutdown_timeout").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.Incremental = fmt.Sprint(ui.Eval(`document.getElementById("settings_incremental").checked.toString();`)) == "true"
+	settings.IncrementalFile = fmt.Sprint(ui.Eval(`document.getElementById("settings_incremental_file").value;`))
+	client = newHTTPClient()
+	settings.UserAgentRotation = fmt.Sprint(ui.Eval(`document.getElementById("settings_user_agent_rotation").value;`))
+	settings.HeaderProfiles = fmt.Sprint(ui.Eval(`document.getElementById("settings_header_profiles").checked.toString();`)) == "true"
+	agents = newUserAgentPool(settings.UserAgents, settings.UserAgentWeights)
 	settings.Captcha = fmt.Sprint(ui.Eval(`document.getElementById("settings_captcha").value;`))
+	settings.Retries, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_retries").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.RetryDelay, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_retry_delay").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.RetryMaxDelay, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_retry_max_delay").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
 	proxyNum, _ := strconv.Atoi(fmt.Sprint(ui.Eval(`proxy_num.toString();`)))
 	settings.Proxy = []string{}
 	for i := 0; i < proxyNum; i++ {
 		code := fmt.Sprintf(`document.getElementById("txt_proxy%d").value;`, i+1)
 		settings.Proxy = append(settings.Proxy, fmt.Sprint(ui.Eval(code)))
 	}
+	settings.ProxyRotation = fmt.Sprint(ui.Eval(`document.getElementById("settings_proxy_rotation").value;`))
+	settings.ProxyMaxFailures, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_proxy_max_failures").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.ProxyRetest, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("settings_proxy_retest").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	settings.ProxyTestURL = fmt.Sprint(ui.Eval(`document.getElementById("settings_proxy_test_url").value;`))
+	proxies = newProxyPool(settings.Proxy)
 	writeJSON()
 	err = ui.Load("data:text/html," + url.PathEscape(uiViewSitemap()))
 	if err != nil {
@@ -222,7 +299,25 @@ func uiEditSettings() string {
 				<tr><th>Gui</th><td><input id="settings_gui" type="checkbox" ` + ifThenElse(settings.Gui, `checked`, "") + `></td></tr>
 				<tr><th>Log</th><td><input id="settings_log" type="checkbox" ` + ifThenElse(settings.Log, `checked`, "") + `></td></tr>
 				<tr><th>JavaScript</th><td><input id="settings_js" type="checkbox" ` + ifThenElse(settings.JavaScript, `checked`, "") + `></td></tr>
+				<tr><th>Respect robots.txt</th><td><input id="settings_robots" type="checkbox" ` + ifThenElse(!settings.IgnoreRobots, `checked`, "") + `></td></tr>
 				<tr><th>Workers</th><td><input id="settings_workers" type="number" value="` + strconv.Itoa(settings.Workers) + `"></td></tr>
+				<tr><th>Requests per second per host</th><td><input id="settings_rate_limit" type="number" step="0.1" value="` + strconv.FormatFloat(settings.RateLimit, 'f', -1, 64) + `"></td></tr>
+				<tr><th>Burst per host</th><td><input id="settings_rate_burst" type="number" value="` + strconv.Itoa(settings.RateBurst) + `"></td></tr>
+				<tr><th>Max in-flight per host</th><td><input id="settings_host_concurrency" type="number" value="` + strconv.Itoa(settings.HostConcurrency) + `"></td></tr>
+				<tr><th>Connect timeout (s)</th><td><input id="settings_connect_timeout" type="number" value="` + strconv.Itoa(settings.ConnectTimeout) + `"></td></tr>
+				<tr><th>Read timeout (s)</th><td><input id="settings_read_timeout" type="number" value="` + strconv.Itoa(settings.ReadTimeout) + `"></td></tr>
+				<tr><th>Request timeout (s)</th><td><input id="settings_request_timeout" type="number" value="` + strconv.Itoa(settings.RequestTimeout) + `"></td></tr>
+				<tr><th>Max idle connections per host</th><td><input id="settings_max_idle_conns" type="number" value="` + strconv.Itoa(settings.MaxIdleConnsPerHost) + `"></td></tr>
+				<tr><th>HTTP/2</th><td><input id="settings_http2" type="checkbox" ` + ifThenElse(settings.HTTP2, `checked`, "") + `></td></tr>
+				<tr><th>Max redirects</th><td><input id="settings_max_redirects" type="number" value="` + strconv.Itoa(settings.MaxRedirects) + `"></td></tr>
+				<tr><th>Max body size (bytes)</th><td><input id="settings_max_body_size" type="number" value="` + strconv.FormatInt(settings.MaxBodySize, 10) + `"></td></tr>
+				<tr><th>Cookie file</th><td><input id="settings_cookie_file" type="text" value="` + settings.CookieFile + `"></td></tr>
+				<tr><th>Import cookies</th><td><input id="settings_cookie_import" type="text" placeholder="cookies.txt or browser export" value="` + settings.CookieImport + `"></td></tr>
+				<tr><th>Checkpoint file</th><td><input id="settings_checkpoint_file" type="text" value="` + settings.CheckpointFile + `"></td></tr>
+				<tr><th>Checkpoint every (s)</th><td><input id="settings_checkpoint_interval" type="number" value="` + strconv.Itoa(settings.CheckpointInterval) + `"></td></tr>
+				<tr><th>Shutdown timeout (s)</th><td><input id="settings_shutdown_timeout" type="number" value="` + strconv.Itoa(settings.ShutdownTimeout) + `"></td></tr>
+				<tr><th>Only new and changed pages</th><td><input id="settings_incremental" type="checkbox" ` + ifThenElse(settings.Incremental, `checked`, "") + `></td></tr>
+				<tr><th>Incremental state file</th><td><input id="settings_incremental_file" type="text" value="` + settings.IncrementalFile + `"></td></tr>
 
 				<tr>
 					<th>Export</th>
@@ -245,7 +340,21 @@ func uiEditSettings() string {
 						<button onclick=addUserAgent()>+</button>
 					</td>
 				</tr>
+				<tr>
+					<th>User agent rotation</th>
+					<td>
+						<select id="settings_user_agent_rotation">
+							<option value="round-robin" ` + ifThenElse(settings.UserAgentRotation != "random" && settings.UserAgentRotation != "sticky", `selected="selected"`, "") + `>Per request</option>
+							<option value="sticky" ` + ifThenElse(settings.UserAgentRotation == "sticky", `selected="selected"`, "") + `>Per domain</option>
+							<option value="random" ` + ifThenElse(settings.UserAgentRotation == "random", `selected="selected"`, "") + `>Weighted random</option>
+						</select>
+					</td>
+				</tr>
+				<tr><th>Header profiles</th><td><input id="settings_header_profiles" type="checkbox" ` + ifThenElse(settings.HeaderProfiles, `checked`, "") + `></td></tr>
 				<tr><th>Captcha</th><td><input id="settings_captcha" type="text" value="` + settings.Captcha + `"></td></tr>
+				<tr><th>Retries</th><td><input id="settings_retries" type="number" value="` + strconv.Itoa(settings.Retries) + `"></td></tr>
+				<tr><th>Retry delay (ms)</th><td><input id="settings_retry_delay" type="number" value="` + strconv.Itoa(settings.RetryDelay) + `"></td></tr>
+				<tr><th>Retry max delay (ms)</th><td><input id="settings_retry_max_delay" type="number" value="` + strconv.Itoa(settings.RetryMaxDelay) + `"></td></tr>
 				<tr>
 					<th>Proxy</th>
 					<td>
@@ -258,6 +367,19 @@ func uiEditSettings() string {
 						<button onclick=addProxy()>+</button>
 					</td>
 				</tr>
+				<tr>
+					<th>Proxy rotation</th>
+					<td>
+						<select id="settings_proxy_rotation">
+							<option value="round-robin" ` + ifThenElse(settings.ProxyRotation != "random" && settings.ProxyRotation != "sticky", `selected="selected"`, "") + `>Round robin</option>
+							<option value="random" ` + ifThenElse(settings.ProxyRotation == "random", `selected="selected"`, "") + `>Random</option>
+							<option value="sticky" ` + ifThenElse(settings.ProxyRotation == "sticky", `selected="selected"`, "") + `>Sticky per domain</option>
+						</select>
+					</td>
+				</tr>
+				<tr><th>Proxy max failures</th><td><input id="settings_proxy_max_failures" type="number" value="` + strconv.Itoa(settings.ProxyMaxFailures) + `"></td></tr>
+				<tr><th>Proxy re-test (s)</th><td><input id="settings_proxy_retest" type="number" value="` + strconv.Itoa(settings.ProxyRetest) + `"></td></tr>
+				<tr><th>Proxy re-test URL</th><td><input id="settings_proxy_test_url" type="text" value="` + settings.ProxyTestURL + `"></td></tr>
 			</table>
 			<div class="buttons">
 				<button onclick="saveSettings()">Save</button>
@@ -303,13 +425,49 @@ func saveMap(ui lorca.UI) {
 		code := fmt.Sprintf(`document.getElementById("txt_starturl%d").value;`, i+1)
 		sitemap.StartURL = append(sitemap.StartURL, fmt.Sprint(ui.Eval(code)))
 	}
+	var err error
+	sitemap.RateLimit, err = strconv.ParseFloat(fmt.Sprint(ui.Eval(`document.getElementById("txt_rate_limit").value;`)), 64)
+	if err != nil {
+		frontendLog(err)
+	}
+	sitemap.HostConcurrency, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("txt_host_concurrency").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	limiter = newRateLimiter(&sitemap)
+	sitemap.Headers = map[string]string{}
+	for _, line := range strings.Split(fmt.Sprint(ui.Eval(`document.getElementById("txt_headers").value;`)), "\n") {
+		header := strings.SplitN(line, ":", 2)
+		if len(header) == 2 && strings.TrimSpace(header[0]) != "" {
+			sitemap.Headers[strings.TrimSpace(header[0])] = strings.TrimSpace(header[1])
+		}
+	}
+	sitemap.MaxDepth, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("txt_max_depth").value;`)))
+	if err != nil {
+		frontendLog(err)
+	}
+	sitemap.AllowedDomains = textLines(fmt.Sprint(ui.Eval(`document.getElementById("txt_allowed_domains").value;`)))
+	sitemap.IncludeURLs = textLines(fmt.Sprint(ui.Eval(`document.getElementById("txt_include_urls").value;`)))
+	sitemap.ExcludeURLs = textLines(fmt.Sprint(ui.Eval(`document.getElementById("txt_exclude_urls").value;`)))
 	writeJSON()
-	err := ui.Load("data:text/html," + url.PathEscape(uiViewSitemap()))
+	err = ui.Load("data:text/html," + url.PathEscape(uiViewSitemap()))
 	if err != nil {
 		frontendLog(err)
 	}
 }
 
+// textLines returns the non-blank lines of a textarea.
+func textLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func uiEditMap() string {
 	page := `
 		<html>
@@ -335,6 +493,24 @@ func uiEditMap() string {
 	page += `</div>
 				<button onclick=removeSiteURL()>-</button>
 				<button onclick=addSiteURL()>+</button>
+				<label for="txt_rate_limit">Requests per second per host: </label>
+				<input type="number" step="0.1" placeholder="Use settings" id="txt_rate_limit" value="` + strconv.FormatFloat(sitemap.RateLimit, 'f', -1, 64) + `"></input>
+				<label for="txt_host_concurrency">Max in-flight per host: </label>
+				<input type="number" placeholder="Use settings" id="txt_host_concurrency" value="` + strconv.Itoa(sitemap.HostConcurrency) + `"></input>
+				<label for="txt_headers">Headers: </label>
+				<textarea id="txt_headers" rows="4" cols="50" placeholder="Name: value">`
+	for key, value := range sitemap.Headers {
+		page += key + ": " + value + "\n"
+	}
+	page += `</textarea>
+				<label for="txt_max_depth">Max depth: </label>
+				<input type="number" placeholder="Unlimited" id="txt_max_depth" value="` + strconv.Itoa(sitemap.MaxDepth) + `"></input>
+				<label for="txt_allowed_domains">Allowed domains: </label>
+				<textarea id="txt_allowed_domains" rows="3" cols="50" placeholder="example.com">` + strings.Join(sitemap.AllowedDomains, "\n") + `</textarea>
+				<label for="txt_include_urls">Include URLs: </label>
+				<textarea id="txt_include_urls" rows="3" cols="50" placeholder="https://example.com/products/* or /regex/">` + strings.Join(sitemap.IncludeURLs, "\n") + `</textarea>
+				<label for="txt_exclude_urls">Exclude URLs: </label>
+				<textarea id="txt_exclude_urls" rows="3" cols="50" placeholder="*.pdf or /regex/">` + strings.Join(sitemap.ExcludeURLs, "\n") + `</textarea>
 				<button onclick=saveMap()>Save</button>
 				<script>
 					let url_num = ` + strconv.Itoa(len(sitemap.StartURL)) + `
@@ -455,6 +631,19 @@ func saveSelector(ui lorca.UI, index int) {
 	el.Multiple = fmt.Sprint(ui.Eval(`document.getElementById("map_multiple").checked.toString();`)) == "true"
 	el.Regex = fmt.Sprint(ui.Eval(`document.getElementById("map_regex").value;`))
 	el.Delay, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("map_delay").value;`)))
+	el.ExtractAttribute = fmt.Sprint(ui.Eval(`document.getElementById("map_extract_attribute").value;`))
+	el.ClickElementSelector = fmt.Sprint(ui.Eval(`document.getElementById("map_click_selector").value;`))
+	el.ClickType = fmt.Sprint(ui.Eval(`document.getElementById("map_click_type").value;`))
+	el.ClickLimit, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("map_click_limit").value;`)))
+	el.ScrollLimit, err = strconv.Atoi(fmt.Sprint(ui.Eval(`document.getElementById("map_scroll_limit").value;`)))
+	el.SitemapXMLURLs = []string{}
+	for _, e := range strings.Split(fmt.Sprint(ui.Eval(`document.getElementById("map_sitemap_urls").value;`)), ",") {
+		if strings.TrimSpace(e) != "" {
+			el.SitemapXMLURLs = append(el.SitemapXMLURLs, strings.TrimSpace(e))
+		}
+	}
+	el.FoundURLRegex = fmt.Sprint(ui.Eval(`document.getElementById("map_found_url_regex").value;`))
+	el.OuterHTML = fmt.Sprint(ui.Eval(`document.getElementById("map_outer_html").checked.toString();`)) == "true"
 	sitemap.Selectors[index] = el
 	writeJSON()
 	err = ui.Load("data:text/html," + url.PathEscape(uiViewSelectors()))
@@ -524,6 +713,20 @@ func uiEditSelector(index int) string {
 					<tr><th>multiple</th><td><input type="checkbox" id="map_multiple" ` + ifThenElse(el.Multiple, `checked"`, "") + `></td></tr>
 					<tr><th>regex</th><td><input type="text" id="map_regex" value="` + el.Regex + `"></td></tr>
 					<tr><th>delay</th><td><input type="number" id="map_delay" value="` + strconv.Itoa(el.Delay) + `"></td></tr>
+					<tr><th>extract attribute</th><td><input type="text" id="map_extract_attribute" placeholder="href or data-sku, data-price" value="` + el.ExtractAttribute + `"></td></tr>
+					<tr><th>click selector</th><td><input type="text" id="map_click_selector" value="` + el.ClickElementSelector + `"></td></tr>
+					<tr>
+						<th>click type</th><td>
+						<select id="map_click_type">
+							<option value="clickMore" ` + ifThenElse(el.ClickType != "clickOnce", `selected`, "") + `>Click more</option>
+							<option value="clickOnce" ` + ifThenElse(el.ClickType == "clickOnce", `selected`, "") + `>Click once</option>
+						</select>
+					</tr>
+					<tr><th>click limit</th><td><input type="number" id="map_click_limit" value="` + strconv.Itoa(el.ClickLimit) + `"></td></tr>
+					<tr><th>scroll limit</th><td><input type="number" id="map_scroll_limit" value="` + strconv.Itoa(el.ScrollLimit) + `"></td></tr>
+					<tr><th>sitemap.xml urls</th><td><input type="text" id="map_sitemap_urls" placeholder="Leave empty to use robots.txt" value="` + strings.Join(el.SitemapXMLURLs, ", ") + `"></td></tr>
+					<tr><th>found url regex</th><td><input type="text" id="map_found_url_regex" value="` + el.FoundURLRegex + `"></td></tr>
+					<tr><th>outer html</th><td><input type="checkbox" id="map_outer_html" ` + ifThenElse(el.OuterHTML, `checked`, "") + `></td></tr>
 				</table>
 				<div class="buttons">
 					<button onclick=deleteSelector(` + strconv.Itoa(index) + `)>Delete</button>
@@ -541,32 +744,10 @@ func selectedElement(ui lorca.UI, index int, str string) {
 }
 
 func uiSelectElement(index int) string {
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
-	}
-
-	if len(settings.Proxy) > 0 {
-		proxyString := settings.Proxy[0]
-		proxyURL, _ := url.Parse(proxyString)
-		transport.Proxy = http.ProxyURL(proxyURL)
-	}
-
-	client := &http.Client{Transport: transport}
-	req, err := http.NewRequest("GET", sitemap.StartURL[0], nil)
+	html, err := requestURL(sitemap.StartURL[0], agents.get(urlHost(sitemap.StartURL[0])))
 	if err != nil {
 		frontendLog(err)
 	}
-	if len(settings.UserAgents) > 0 {
-		req.Header.Set("User-Agent", settings.UserAgents[0])
-	}
-	resp, err := client.Do(req)
-	var html []byte
-	if err == nil {
-		html, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			frontendLog(err)
-		}
-	}
 
 	page := string(html)
 	insertIndex := strings.Index(page, "</body>")
@@ -693,6 +874,8 @@ func bindFunctions(ui lorca.UI) error {
 }
 
 func main() {
+	flag.BoolVar(&resume, "resume", false, "continue the crawl saved in the checkpoint file")
+	flag.Parse()
 	readJSON()
 
 	if !settings.Gui {
@@ -8,4 +8,5 @@ require (
 	github.com/chromedp/chromedp v0.5.3
 	github.com/dlclark/regexp2 v1.4.0
 	github.com/zserge/lorca v0.1.9
+	golang.org/x/net v0.0.0-20200222125558-5a598a2470a0
 )